@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// ChargingSession follows a charge from the car entering Teslamate's "charging"
+// state until it leaves it. Power is in kW and energy in kWh; RangeAdded is in
+// the configured units once applyUnits has run.
+type ChargingSession struct {
+	Active          bool      `json:"active"`
+	StartedAt       time.Time `json:"started_at"`
+	EndedAt         time.Time `json:"ended_at"` // Zero while charging
+	DurationSeconds float64   `json:"duration_seconds"`
+	EnergyAdded     float64   `json:"energy_added"` // kWh
+	Power           float64   `json:"power"`        // kW, zero once ended
+	MaxPower        float64   `json:"max_power"`
+	AvgPower        float64   `json:"avg_power"` // Energy added over the duration
+	Voltage         float64   `json:"voltage"`
+	Current         float64   `json:"current"`
+	StartBattery    float64   `json:"start_battery"`
+	Battery         float64   `json:"battery"` // Now, or when the session ended
+	ChargeLimit     float64   `json:"charge_limit"`
+	MinutesToLimit  float64   `json:"minutes_to_limit"` // Until the ETA, zero once ended
+	ETA             time.Time `json:"eta"`              // When the charge limit will be reached, zero when unknown
+	RangeAddedKm    float64   `json:"range_added_km"`
+	RangeAdded      float64   `json:"range_added"`
+
+	startRange float64
+	timeToFull float64   // Hours, as last published in time_to_full_charge
+	estimateAt time.Time // When it was published
+
+	// Teslamate keeps publishing the previous charge's charge_energy_added until
+	// the car reports the new charge, so it is ignored until it changes
+	staleEnergy float64
+}
+
+// chargingSummaryDuration is how long a finished session stays on the overlay and in /location
+const chargingSummaryDuration = 30 * time.Minute
+
+var (
+	chargingSessions = map[int]*ChargingSession{}
+	chargingMutex    sync.Mutex
+)
+
+// startChargingSession begins a session when the car starts charging, replacing the previous one
+func startChargingSession(loc Location) {
+	chargingMutex.Lock()
+	defer chargingMutex.Unlock()
+
+	session := &ChargingSession{
+		Active:       true,
+		StartedAt:    time.Now(),
+		StartBattery: loc.Battery,
+		startRange:   loc.Range,
+		staleEnergy:  loc.ChargeEnergyAdded,
+	}
+	chargingSessions[loc.CarID] = session
+	updateChargingSession(session, loc)
+}
+
+// endChargingSession closes the car's session when it stops charging, logs the
+// summary and returns the finished session
+func endChargingSession(loc Location) (ChargingSession, bool) {
+	chargingMutex.Lock()
+	defer chargingMutex.Unlock()
+
+	session, ok := chargingSessions[loc.CarID]
+	if !ok || !session.Active {
+		return ChargingSession{}, false
+	}
+	updateChargingSession(session, loc)
+	session.Active = false
+	session.EndedAt = time.Now()
+	session.Power = 0
+	session.MinutesToLimit = 0
+	session.ETA = time.Time{}
+	log.Printf("Car %d finished charging: +%.1f kWh, %.0f%% to %.0f%% in %s",
+		loc.CarID, session.EnergyAdded, session.StartBattery, session.Battery, formatTripDuration(session.EndedAt.Sub(session.StartedAt).Seconds()))
+	return *session, true
+}
+
+// sampleCharging updates the active session from the car's latest charging values
+func sampleCharging(loc Location) {
+	chargingMutex.Lock()
+	defer chargingMutex.Unlock()
+
+	if session, ok := chargingSessions[loc.CarID]; ok && session.Active {
+		updateChargingSession(session, loc)
+	}
+}
+
+// updateChargingSession copies the car's charging values into the session, chargingMutex must be held
+func updateChargingSession(session *ChargingSession, loc Location) {
+	session.Power = loc.ChargerPower
+	session.MaxPower = math.Max(session.MaxPower, loc.ChargerPower)
+	session.Voltage = loc.ChargerVoltage
+	session.Current = loc.ChargerActualCurrent
+	session.ChargeLimit = loc.ChargeLimitSoc
+	if loc.ChargeEnergyAdded != session.staleEnergy {
+		session.staleEnergy = 0
+		session.EnergyAdded = loc.ChargeEnergyAdded
+	}
+	if loc.Battery > 0 {
+		session.Battery = loc.Battery
+	}
+	if loc.Range > 0 && session.startRange > 0 {
+		session.RangeAddedKm = math.Max(0, loc.Range-session.startRange)
+	}
+	if loc.TimeToFullCharge != session.timeToFull || session.estimateAt.IsZero() {
+		session.timeToFull = loc.TimeToFullCharge
+		session.estimateAt = time.Now()
+	}
+}
+
+// getChargingSession returns the car's current session, or the last one for a
+// while after it ended, with the derived totals filled in. The ETA and the
+// minutes left both count down from Teslamate's last estimate.
+func getChargingSession(carID int) (ChargingSession, bool) {
+	chargingMutex.Lock()
+	defer chargingMutex.Unlock()
+
+	session, ok := chargingSessions[carID]
+	if !ok || (!session.Active && time.Since(session.EndedAt) > chargingSummaryDuration) {
+		return ChargingSession{}, false
+	}
+
+	snapshot := *session
+	end := snapshot.EndedAt
+	if snapshot.Active {
+		end = time.Now()
+		if snapshot.timeToFull > 0 {
+			eta := snapshot.estimateAt.Add(time.Duration(snapshot.timeToFull * float64(time.Hour)))
+			snapshot.ETA = eta.UTC().Truncate(time.Minute)
+			snapshot.MinutesToLimit = math.Max(0, math.Round(eta.Sub(end).Minutes()))
+		}
+	}
+	snapshot.DurationSeconds = end.Sub(snapshot.StartedAt).Seconds()
+	// Averages over the first minute mostly measure Teslamate's polling delay
+	if snapshot.DurationSeconds >= 60 {
+		snapshot.AvgPower = snapshot.EnergyAdded / (snapshot.DurationSeconds / 3600)
+	}
+	return snapshot, true
+}
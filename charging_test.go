@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestChargingSession(t *testing.T) {
+	const carID = 9201
+	t.Cleanup(func() {
+		chargingMutex.Lock()
+		delete(chargingSessions, carID)
+		chargingMutex.Unlock()
+	})
+
+	// Teslamate still reports the previous charge's 30 kWh when charging starts
+	loc := Location{CarID: carID, Battery: 40, Range: 200, ChargeEnergyAdded: 30, ChargeLimitSoc: 80}
+	startChargingSession(loc)
+	sampleCharging(loc)
+	if session, _ := getChargingSession(carID); session.EnergyAdded != 0 {
+		t.Errorf("energy added = %v kWh, want the previous charge's value ignored", session.EnergyAdded)
+	}
+
+	for _, sample := range []struct{ energy, power, battery float64 }{{2.5, 150, 45}, {10, 120, 60}} {
+		loc.ChargeEnergyAdded, loc.ChargerPower, loc.Battery, loc.Range = sample.energy, sample.power, sample.battery, 300
+		sampleCharging(loc)
+	}
+	session, ok := getChargingSession(carID)
+	if !ok || !session.Active {
+		t.Fatalf("session = %+v, want an active one", session)
+	}
+	if session.EnergyAdded != 10 || session.Power != 120 || session.MaxPower != 150 {
+		t.Errorf("energy %v kWh, power %v kW, max %v kW, want 10, 120 and 150", session.EnergyAdded, session.Power, session.MaxPower)
+	}
+	if session.StartBattery != 40 || session.Battery != 60 || session.RangeAddedKm != 100 {
+		t.Errorf("battery %v%% to %v%%, range +%v km, want 40%% to 60%% and +100 km", session.StartBattery, session.Battery, session.RangeAddedKm)
+	}
+
+	ended, ok := endChargingSession(loc)
+	if !ok || ended.Active || ended.EndedAt.IsZero() || ended.Power != 0 || ended.EnergyAdded != 10 {
+		t.Errorf("ended session = %+v, want it closed with 10 kWh added", ended)
+	}
+	if _, ok := endChargingSession(loc); ok {
+		t.Error("a finished session was ended twice")
+	}
+
+	// The summary stays on show for a while
+	if _, ok := getChargingSession(carID); !ok {
+		t.Error("finished session not reported")
+	}
+	chargingMutex.Lock()
+	chargingSessions[carID].EndedAt = time.Now().Add(-chargingSummaryDuration - time.Minute)
+	chargingMutex.Unlock()
+	if _, ok := getChargingSession(carID); ok {
+		t.Error("finished session still reported after the summary period")
+	}
+}
+
+func TestChargingSessionCountsDown(t *testing.T) {
+	const carID = 9202
+	t.Cleanup(func() {
+		chargingMutex.Lock()
+		delete(chargingSessions, carID)
+		chargingMutex.Unlock()
+	})
+
+	startChargingSession(Location{CarID: carID, TimeToFullCharge: 0.5})
+	// Teslamate's estimate of 30 minutes is now 10 minutes old
+	chargingMutex.Lock()
+	estimateAt := time.Now().Add(-10 * time.Minute)
+	chargingSessions[carID].estimateAt = estimateAt
+	chargingMutex.Unlock()
+
+	session, _ := getChargingSession(carID)
+	if session.MinutesToLimit != 20 {
+		t.Errorf("minutes to limit = %v, want 20", session.MinutesToLimit)
+	}
+	if want := estimateAt.Add(30 * time.Minute).UTC().Truncate(time.Minute); !session.ETA.Equal(want) {
+		t.Errorf("ETA = %v, want %v", session.ETA, want)
+	}
+	if eta := time.Until(session.ETA).Minutes(); math.Abs(eta-session.MinutesToLimit) > 1 {
+		t.Errorf("ETA is %.1f minutes away but %v minutes are left", eta, session.MinutesToLimit)
+	}
+}
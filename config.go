@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	configFile  = envOrDefault("CONFIG_FILE", "config.json")
+	configMutex sync.RWMutex
+
+	// What CONFIG_FILE holds, without environment overrides. Guarded by
+	// configUpdateMutex once the server is running.
+	savedConfig Config
+
+	// Held by an admin save from reading the current config until the new one
+	// is saved, so two saves at once can't undo each other
+	configUpdateMutex sync.Mutex
+)
+
+func defaultConfig() Config {
+	return Config{
+		ShowRoute:      true,
+		OverlayEnabled: true,
+		MapEnabled:     true,
+		DefaultCarID:   1,
+		HomeLabel:      "Home",
+		Units:          unitsMetric,
+
+		Geocoder:         geocoderNominatim,
+		WeatherProvider:  weatherOpenMeteo,
+		TimezoneProvider: timezoneAuto,
+
+		TripAutoStart:     true,
+		TripAutoStopAfter: 60,
+
+		LocationStaleAfter: 300,
+
+		OverlayFileInterval: 1,
+
+		OverlayImage: defaultOverlayImageOptions(),
+
+		BatteryAlertLevel: 20,
+	}
+}
+
+// loadConfig builds the startup configuration. Precedence, lowest to highest:
+//  1. built-in defaults
+//  2. CONFIG_FILE (written by the admin panel)
+//  3. environment variables
+func loadConfig() (Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(configFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.Printf("No config file at %s, using defaults", configFile)
+	case err != nil:
+		return cfg, fmt.Errorf("reading %s: %w", configFile, err)
+	default:
+		// Fields missing from the file keep their defaults
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing %s: %w", configFile, err)
+		}
+		log.Printf("Loaded config from %s", configFile)
+	}
+
+	savedConfig = cfg
+	applyEnvOverrides(&cfg)
+
+	if cfg.MapboxToken != "" && !strings.HasPrefix(cfg.MapboxToken, "pk.") {
+		log.Printf("Warning: Mapbox token is not a public (pk.) token and will not be sent to browsers")
+	}
+	if cfg.TimezoneBoundaryFile == "" && (cfg.TimezoneProvider == providerOffline || (cfg.TimezoneProvider == timezoneAuto && cfg.TimeZoneDBToken == "")) {
+		log.Printf("Warning: no TZ_BOUNDARY_FILE for offline time zone lookups, local times will be shown in UTC")
+	}
+	return cfg, nil
+}
+
+// envField ties an environment variable to the Config field it overrides
+type envField struct {
+	key    string
+	target interface{} // *string, *bool or *int
+}
+
+// envFields lists every environment override of cfg's fields
+func envFields(cfg *Config) []envField {
+	return []envField{
+		{"MAPBOX_TOKEN", &cfg.MapboxToken},
+		{"TIMEZONEDB_TOKEN", &cfg.TimeZoneDBToken},
+		{"SHOW_ROUTE", &cfg.ShowRoute},
+		{"MAP_ENABLED", &cfg.MapEnabled},
+		{"OVERLAY_ENABLED", &cfg.OverlayEnabled},
+		{"DEFAULT_CAR_ID", &cfg.DefaultCarID},
+		{"UNITS", &cfg.Units},
+		{"GEOCODER", &cfg.Geocoder},
+		{"GEOCODER_URL", &cfg.GeocoderURL},
+		{"GEONAMES_FILE", &cfg.GeoNamesFile},
+		{"WEATHER_PROVIDER", &cfg.WeatherProvider},
+		{"OPENWEATHERMAP_TOKEN", &cfg.OpenWeatherMapToken},
+		{"TIMEZONE_PROVIDER", &cfg.TimezoneProvider},
+		{"TZ_BOUNDARY_FILE", &cfg.TimezoneBoundaryFile},
+		{"TRIP_AUTO_START", &cfg.TripAutoStart},
+		{"TRIP_AUTO_STOP_AFTER", &cfg.TripAutoStopAfter},
+		{"PUBLIC_TRAIL", &cfg.PublicTrail},
+		{"LOCATION_STALE_AFTER", &cfg.LocationStaleAfter},
+		{"OVERLAY_FILE", &cfg.OverlayFile},
+		{"OVERLAY_FIELD_DIR", &cfg.OverlayFieldDir},
+		{"OVERLAY_FILE_INTERVAL", &cfg.OverlayFileInterval},
+		{"OBS_URL", &cfg.OBSURL},
+		{"OBS_PASSWORD", &cfg.OBSPassword},
+		{"WEBHOOK_SECRET", &cfg.WebhookSecret},
+		{"BATTERY_ALERT_LEVEL", &cfg.BatteryAlertLevel},
+	}
+}
+
+// applyEnvOverrides lets environment variables win over the config file.
+// Only variables that are set (non-empty) are applied.
+func applyEnvOverrides(cfg *Config) {
+	for _, field := range envFields(cfg) {
+		switch target := field.target.(type) {
+		case *string:
+			overrideString(field.key, target)
+		case *bool:
+			overrideBool(field.key, target)
+		case *int:
+			overrideInt(field.key, target)
+		}
+	}
+}
+
+// withoutEnvOverrides returns cfg with every field set from the environment
+// put back to its value in saved, so environment secrets never reach CONFIG_FILE
+func withoutEnvOverrides(cfg, saved Config) Config {
+	savedFields := envFields(&saved)
+	for i, field := range envFields(&cfg) {
+		if os.Getenv(field.key) == "" {
+			continue
+		}
+		switch target := field.target.(type) {
+		case *string:
+			*target = *savedFields[i].target.(*string)
+		case *bool:
+			*target = *savedFields[i].target.(*bool)
+		case *int:
+			*target = *savedFields[i].target.(*int)
+		}
+	}
+	return cfg
+}
+
+func overrideString(key string, target *string) {
+	if value := os.Getenv(key); value != "" {
+		*target = value
+	}
+}
+
+func overrideBool(key string, target *bool) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ignoring %s=%q: %v", key, value, err)
+		return
+	}
+	*target = parsed
+}
+
+func overrideInt(key string, target *int) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Ignoring %s=%q: %v", key, value, err)
+		return
+	}
+	*target = parsed
+}
+
+// decodeConfigUpdate applies a JSON update from the admin panel on top of the
+// current config. Lists are decoded into fresh slices: encoding/json would
+// otherwise write into the elements the running config still shares, and keep
+// old field values in resubmitted elements. Lists and other fields the request
+// leaves out, including the write-only secrets, keep their current values.
+// The overlay file paths can't be changed from the admin panel at all.
+func decodeConfigUpdate(current Config, body []byte) (Config, error) {
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(body, &present); err != nil {
+		return current, err
+	}
+
+	update := current
+	update.PrivacyZones = nil
+	update.ReferencePoints = nil
+	update.OBSRules = nil
+	update.Webhooks = nil
+	if err := json.Unmarshal(body, &update); err != nil {
+		return current, err
+	}
+
+	if _, ok := present["privacy_zones"]; !ok {
+		update.PrivacyZones = current.PrivacyZones
+	}
+	if _, ok := present["reference_points"]; !ok {
+		update.ReferencePoints = current.ReferencePoints
+	}
+	if _, ok := present["obs_rules"]; !ok {
+		update.OBSRules = current.OBSRules
+	}
+	if _, ok := present["webhooks"]; !ok {
+		update.Webhooks = current.Webhooks
+	}
+
+	// The server writes to these paths, so they only come from OVERLAY_FILE,
+	// OVERLAY_FIELD_DIR or the config file
+	update.OverlayFile = current.OverlayFile
+	update.OverlayFieldDir = current.OverlayFieldDir
+	return update, nil
+}
+
+// validateConfig rejects configurations submitted from the admin panel that can't work
+func validateConfig(cfg Config) error {
+	if cfg.MapboxToken != "" && !strings.HasPrefix(cfg.MapboxToken, "pk.") {
+		return errors.New("Mapbox token must be a public (pk.) token, it is sent to the browser")
+	}
+	if err := validateUnits(cfg.Units); err != nil {
+		return err
+	}
+	if err := validateProviders(cfg); err != nil {
+		return err
+	}
+	for _, zone := range cfg.PrivacyZones {
+		if err := zone.validate(); err != nil {
+			return err
+		}
+	}
+	for _, point := range cfg.ReferencePoints {
+		if err := point.validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.OBSURL != "" && !strings.HasPrefix(cfg.OBSURL, "ws://") && !strings.HasPrefix(cfg.OBSURL, "wss://") {
+		return errors.New("OBS WebSocket URL must start with ws:// or wss://")
+	}
+	for _, rule := range cfg.OBSRules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateWebhooks(cfg); err != nil {
+		return err
+	}
+	if cfg.TripAutoStopAfter < 0 {
+		return errors.New("trip auto stop time can't be negative")
+	}
+	if cfg.LocationStaleAfter < 0 {
+		return errors.New("location stale threshold can't be negative")
+	}
+	if cfg.OverlayFileInterval < 0 {
+		return errors.New("overlay file interval can't be negative")
+	}
+	if err := cfg.OverlayImage.withDefaults().validate(); err != nil {
+		return err
+	}
+	if cfg.OverlayTemplate != "" {
+		if _, err := compileOverlayTemplate(cfg.OverlayTemplate, cfg); err != nil {
+			return fmt.Errorf("overlay template: %w", err)
+		}
+	}
+	return nil
+}
+
+func getConfig() Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
+}
+
+// updateConfig replaces the running configuration, saves it to CONFIG_FILE and
+// notifies /events clients. Callers hold configUpdateMutex.
+func updateConfig(cfg Config) error {
+	configMutex.Lock()
+	config = cfg
+	configMutex.Unlock()
+
+	events.publish("config", 0, publicConfig(cfg))
+	return saveConfig(cfg)
+}
+
+// saveConfig writes cfg to CONFIG_FILE, except for values that came from the
+// environment: those keep what the file had, since the environment wins at
+// startup anyway and may hold secrets that belong in no file
+func saveConfig(cfg Config) error {
+	persisted := withoutEnvOverrides(cfg, savedConfig)
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The file holds API tokens, keep it private
+	if err := writeFileAtomic(configFile, data, 0600); err != nil {
+		return err
+	}
+	savedConfig = persisted
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and renames it
+// over path, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // No-op once the rename succeeded
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, path)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigDefaults(t *testing.T) {
+	if err := validateConfig(defaultConfig()); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+}
+
+func TestValidateConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string // Part of the error message
+	}{
+		{"secret Mapbox token", func(c *Config) { c.MapboxToken = "sk.secret" }, "public (pk.) token"},
+		{"unknown units", func(c *Config) { c.Units = "furlongs" }, "unknown unit system"},
+		{"unknown geocoder", func(c *Config) { c.Geocoder = "atlas" }, "unknown geocoder"},
+		{"geocoder URL scheme", func(c *Config) { c.GeocoderURL = "ftp://example.com" }, "geocoder URL"},
+		{"unknown weather provider", func(c *Config) { c.WeatherProvider = "almanac" }, "unknown weather provider"},
+		{"unknown timezone provider", func(c *Config) { c.TimezoneProvider = "sundial" }, "unknown timezone provider"},
+		{"privacy zone without radius", func(c *Config) {
+			c.PrivacyZones = []PrivacyZone{{Name: "home", Latitude: -32, Longitude: 115}}
+		}, "radius must be greater than zero"},
+		{"privacy zone polygon too short", func(c *Config) {
+			c.PrivacyZones = []PrivacyZone{{Name: "home", Polygon: [][2]float64{{-32, 115}, {-32.1, 115}}}}
+		}, "at least 3 points"},
+		{"privacy zone mode", func(c *Config) {
+			c.PrivacyZones = []PrivacyZone{{Name: "home", RadiusM: 100, Mode: "blur"}}
+		}, "unknown mode"},
+		{"reference point without label", func(c *Config) {
+			c.ReferencePoints = []ReferencePoint{{Latitude: -32, Longitude: 115}}
+		}, "needs a label"},
+		{"OBS URL scheme", func(c *Config) { c.OBSURL = "http://localhost:4455" }, "ws:// or wss://"},
+		{"OBS rule trigger", func(c *Config) {
+			c.OBSRules = []OBSRule{{On: "arrival", Action: obsSwitchScene, Scene: "Parked"}}
+		}, "unknown trigger"},
+		{"OBS rule without scene", func(c *Config) {
+			c.OBSRules = []OBSRule{{On: obsOnState, Value: "charging", Action: obsSwitchScene}}
+		}, "needs a scene name"},
+		{"webhook URL", func(c *Config) { c.Webhooks = []Webhook{{URL: "example.com/hook"}} }, "http:// or https://"},
+		{"webhook event", func(c *Config) {
+			c.Webhooks = []Webhook{{URL: "https://example.com/hook", Events: []string{"teleported"}}}
+		}, "unknown event"},
+		{"battery alert level", func(c *Config) { c.BatteryAlertLevel = 101 }, "between 0 and 100"},
+		{"negative trip auto stop", func(c *Config) { c.TripAutoStopAfter = -1 }, "can't be negative"},
+		{"negative stale threshold", func(c *Config) { c.LocationStaleAfter = -1 }, "can't be negative"},
+		{"negative overlay file interval", func(c *Config) { c.OverlayFileInterval = -1 }, "can't be negative"},
+		{"overlay image size", func(c *Config) { c.OverlayImage.Width = 10 }, "overlay image size"},
+		{"overlay image colour", func(c *Config) { c.OverlayImage.Color = "#ggg" }, "invalid colour"},
+		{"overlay template", func(c *Config) { c.OverlayTemplate = "{{.Missing}}" }, "overlay template: line 1"},
+	}
+	for _, test := range tests {
+		cfg := defaultConfig()
+		test.change(&cfg)
+		err := validateConfig(cfg)
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %q, want it to mention %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestDecodeConfigUpdate(t *testing.T) {
+	current := defaultConfig()
+	current.MapboxToken = "pk.current"
+	current.PrivacyZones = []PrivacyZone{{Name: "home", Label: "Near home", RadiusM: 500, Mode: privacyModeFuzz}}
+	current.OBSRules = []OBSRule{{On: obsOnState, Value: "charging", Action: obsSwitchScene, Scene: "Charging"}}
+
+	update, err := decodeConfigUpdate(current, []byte(`{"privacy_zones": [{"name": "work", "radius_m": 200}], "obs_rules": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(update.PrivacyZones) != 1 || !reflect.DeepEqual(update.PrivacyZones[0], PrivacyZone{Name: "work", RadiusM: 200}) {
+		t.Errorf("privacy zones = %+v, want only the submitted zone without old fields", update.PrivacyZones)
+	}
+	if current.PrivacyZones[0].Name != "home" {
+		t.Errorf("the current config's zone was overwritten: %+v", current.PrivacyZones[0])
+	}
+	if len(update.OBSRules) != 0 {
+		t.Errorf("OBS rules = %+v, want them cleared", update.OBSRules)
+	}
+	if update.MapboxToken != "pk.current" {
+		t.Errorf("Mapbox token = %q, want the current one kept", update.MapboxToken)
+	}
+
+	current.OverlayFile = "/var/lib/tesla-location/overlay.txt"
+	update, err = decodeConfigUpdate(current, []byte(`{"overlay_file": "/etc/passwd", "overlay_field_dir": "/etc"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.OverlayFile != current.OverlayFile || update.OverlayFieldDir != "" {
+		t.Errorf("overlay paths = %q, %q, want them unchanged by the admin panel", update.OverlayFile, update.OverlayFieldDir)
+	}
+
+	if _, err := decodeConfigUpdate(current, []byte(`{"privacy_zones": "home"}`)); err == nil {
+		t.Error("invalid JSON was accepted")
+	}
+}
+
+func TestWithoutEnvOverrides(t *testing.T) {
+	saved := defaultConfig()
+	saved.OBSPassword = "from-file"
+	cfg := saved
+	t.Setenv("OBS_PASSWORD", "from-env")
+	t.Setenv("SHOW_ROUTE", "false")
+	applyEnvOverrides(&cfg)
+	cfg.Units = unitsImperial // Changed in the admin panel
+
+	persisted := withoutEnvOverrides(cfg, saved)
+	if persisted.OBSPassword != "from-file" || persisted.ShowRoute != saved.ShowRoute {
+		t.Errorf("OBS password %q, show route %v, want the file's values", persisted.OBSPassword, persisted.ShowRoute)
+	}
+	if persisted.Units != unitsImperial {
+		t.Errorf("units = %q, want the admin change kept", persisted.Units)
+	}
+	if cfg.OBSPassword != "from-env" {
+		t.Errorf("the running config was changed: %q", cfg.OBSPassword)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamEvent is a single Server-Sent Event fanned out to every /events client
+type streamEvent struct {
+	Name  string
+	CarID int // 0 for events that apply to every car, e.g. config
+	Data  []byte
+}
+
+type eventHub struct {
+	mutex   sync.Mutex
+	clients map[chan streamEvent]struct{}
+}
+
+// Car updates arrive one MQTT topic at a time (latitude and longitude separately),
+// so they are coalesced for a short window before being pushed to browsers.
+const carEventDelay = 250 * time.Millisecond
+
+var (
+	events            = &eventHub{clients: map[chan streamEvent]struct{}{}}
+	pendingCarEvents  = map[string]bool{}
+	pendingEventMutex sync.Mutex
+)
+
+func (h *eventHub) subscribe() chan streamEvent {
+	ch := make(chan streamEvent, 16)
+	h.mutex.Lock()
+	h.clients[ch] = struct{}{}
+	h.mutex.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan streamEvent) {
+	h.mutex.Lock()
+	delete(h.clients, ch)
+	h.mutex.Unlock()
+}
+
+// publish never blocks: slow clients miss events rather than stalling messageHandler
+func (h *eventHub) publish(name string, carID int, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", name, err)
+		return
+	}
+
+	event := streamEvent{Name: name, CarID: carID, Data: data}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// queueCarEvent schedules a "location" or "route" event with the car's latest state
+func queueCarEvent(carID int, name string) {
+	key := fmt.Sprintf("%d/%s", carID, name)
+
+	pendingEventMutex.Lock()
+	defer pendingEventMutex.Unlock()
+	if pendingCarEvents[key] {
+		return
+	}
+	pendingCarEvents[key] = true
+
+	time.AfterFunc(carEventDelay, func() {
+		pendingEventMutex.Lock()
+		delete(pendingCarEvents, key)
+		pendingEventMutex.Unlock()
+
+		if loc, ok := getPublicLocation(carID); ok {
+			events.publish(name, carID, loc)
+		}
+	})
+}
+
+func writeEvent(w http.ResponseWriter, name string, data []byte) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+}
+
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	carID, err := requestedCarID(r)
+	if err != nil {
+		http.Error(w, "Invalid car parameter", http.StatusBadRequest)
+		return
+	}
+	// Without an explicit car the stream follows the default car, even if it changes
+	followDefault := carQuery(r) == ""
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	// Send the current state straight away so pages don't wait for the next MQTT message
+	if data, err := json.Marshal(publicConfig(getConfig())); err == nil {
+		writeEvent(w, "config", data)
+	}
+	if loc, ok := getPublicLocation(carID); ok && getConfig().MapEnabled {
+		if data, err := json.Marshal(loc); err == nil {
+			writeEvent(w, "location", data)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-ch:
+			cfg := getConfig()
+			if followDefault {
+				carID = cfg.DefaultCarID
+			}
+			if event.CarID != 0 {
+				if event.CarID != carID || !cfg.MapEnabled {
+					continue
+				}
+			}
+			writeEvent(w, event.Name, event.Data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// trackExport is a set of tracks ready to be written in one of the export formats
+type trackExport struct {
+	Name   string
+	CarID  int
+	Tracks [][]TrailPoint
+}
+
+type exportFormat struct {
+	contentType string
+	write       func(io.Writer, trackExport) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"gpx":     {"application/gpx+xml", writeGPX},
+	"kml":     {"application/vnd.google-earth.kml+xml", writeKML},
+	"geojson": {"application/geo+json", writeGeoJSON},
+}
+
+// exportTracks picks the tracks to export. A chosen segment is exported whatever
+// its state, otherwise only drives are, stops are of no use on Strava or Google Earth.
+func exportTracks(points []TrailPoint, filter trailFilter, zones []PrivacyZone) [][]TrailPoint {
+	tracks := [][]TrailPoint{}
+	for _, track := range trailTracks(points, zones) {
+		if len(track) < 2 || (filter.Segment == 0 && track[0].State != "driving") {
+			continue
+		}
+		tracks = append(tracks, track)
+	}
+	return tracks
+}
+
+func trackName(track []TrailPoint) string {
+	kind := "Drive"
+	if track[0].State != "driving" {
+		kind = "Stop"
+	}
+	return fmt.Sprintf("%s %s (%.1f km)", kind, track[0].Time.Local().Format("2006-01-02 15:04"), trackDistance(track))
+}
+
+// exportFileName names the download after the first track, e.g. tesla-1-20240501-0815.gpx
+func exportFileName(export trackExport, format string) string {
+	stamp := time.Now().Local()
+	if len(export.Tracks) > 0 {
+		stamp = export.Tracks[0][0].Time.Local()
+	}
+	return fmt.Sprintf("tesla-%d-%s.%s", export.CarID, stamp.Format("20060102-1504"), format)
+}
+
+// gpxtpxNamespace is Garmin's TrackPointExtension. GPX 1.1 has no speed or
+// course elements, they go in this extension which Strava, Garmin Connect and
+// most GPX tools read.
+const gpxtpxNamespace = "http://www.garmin.com/xmlschemas/TrackPointExtension/v2"
+
+type gpxFile struct {
+	XMLName  xml.Name    `xml:"gpx"`
+	Version  string      `xml:"version,attr"`
+	Creator  string      `xml:"creator,attr"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Metadata gpxMetadata `xml:"metadata"`
+	Tracks   []gpxTrack  `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name string `xml:"name"`
+	Time string `xml:"time"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name"`
+	Type    string     `xml:"type"`
+	Segment gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Latitude   float64       `xml:"lat,attr"`
+	Longitude  float64       `xml:"lon,attr"`
+	Elevation  float64       `xml:"ele"`
+	Time       string        `xml:"time"`
+	Extensions gpxExtensions `xml:"extensions"`
+}
+
+type gpxExtensions struct {
+	TrackPointExtension gpxTrackPointExtension
+}
+
+// gpxTrackPointExtension is written in gpxtpxNamespace, its elements inherit it
+type gpxTrackPointExtension struct {
+	XMLName xml.Name
+	Speed   float64 `xml:"speed"`  // m/s
+	Course  float64 `xml:"course"` // Degrees from north
+}
+
+func writeGPX(w io.Writer, export trackExport) error {
+	gpx := gpxFile{
+		Version:  "1.1",
+		Creator:  "obs-teslamate",
+		Xmlns:    "http://www.topografix.com/GPX/1/1",
+		Metadata: gpxMetadata{Name: export.Name, Time: time.Now().UTC().Format(time.RFC3339)},
+	}
+	for _, track := range export.Tracks {
+		gpxTrack := gpxTrack{Name: trackName(track), Type: track[0].State}
+		for _, point := range track {
+			gpxTrack.Segment.Points = append(gpxTrack.Segment.Points, gpxPoint{
+				Latitude:  point.Latitude,
+				Longitude: point.Longitude,
+				Elevation: point.Elevation,
+				Time:      point.Time.UTC().Format(time.RFC3339),
+				Extensions: gpxExtensions{gpxTrackPointExtension{
+					XMLName: xml.Name{Space: gpxtpxNamespace, Local: "TrackPointExtension"},
+					Speed:   math.Round(point.Speed/3.6*100) / 100,
+					Course:  point.Heading,
+				}},
+			})
+		}
+		gpx.Tracks = append(gpx.Tracks, gpxTrack)
+	}
+	return writeXML(w, gpx)
+}
+
+type kmlFile struct {
+	XMLName  xml.Name    `xml:"kml"`
+	Xmlns    string      `xml:"xmlns,attr"`
+	Document kmlDocument `xml:"Document"`
+}
+
+type kmlDocument struct {
+	Name       string         `xml:"name"`
+	Style      kmlStyle       `xml:"Style"`
+	Placemarks []kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlStyle struct {
+	ID    string `xml:"id,attr"`
+	Color string `xml:"LineStyle>color"` // aabbggrr
+	Width int    `xml:"LineStyle>width"`
+}
+
+type kmlPlacemark struct {
+	Name        string        `xml:"name"`
+	Description string        `xml:"description"`
+	Begin       string        `xml:"TimeSpan>begin"`
+	End         string        `xml:"TimeSpan>end"`
+	StyleURL    string        `xml:"styleUrl"`
+	LineString  kmlLineString `xml:"LineString"`
+}
+
+type kmlLineString struct {
+	Tessellate   int    `xml:"tessellate"`
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+func writeKML(w io.Writer, export trackExport) error {
+	kml := kmlFile{
+		Xmlns: "http://www.opengis.net/kml/2.2",
+		Document: kmlDocument{
+			Name:  export.Name,
+			Style: kmlStyle{ID: "track", Color: "ff1673f9", Width: 4},
+		},
+	}
+	for _, track := range export.Tracks {
+		coordinates := make([]string, len(track))
+		for i, point := range track {
+			coordinates[i] = fmt.Sprintf("%.6f,%.6f,%.1f", point.Longitude, point.Latitude, point.Elevation)
+		}
+		start, end := track[0].Time, track[len(track)-1].Time
+		kml.Document.Placemarks = append(kml.Document.Placemarks, kmlPlacemark{
+			Name:        trackName(track),
+			Description: fmt.Sprintf("%.1f km in %s", trackDistance(track), end.Sub(start).Round(time.Minute)),
+			Begin:       start.UTC().Format(time.RFC3339),
+			End:         end.UTC().Format(time.RFC3339),
+			StyleURL:    "#track",
+			LineString: kmlLineString{
+				Tessellate:   1,
+				AltitudeMode: "clampToGround",
+				Coordinates:  strings.Join(coordinates, " "),
+			},
+		})
+	}
+	return writeXML(w, kml)
+}
+
+func writeGeoJSON(w io.Writer, export trackExport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(trailFeatureCollection(export.CarID, export.Tracks))
+}
+
+func writeXML(w io.Writer, document interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func exportName(carID int) string {
+	if loc, ok := getCarLocation(carID); ok && loc.DisplayName != "" {
+		return loc.DisplayName
+	}
+	return fmt.Sprintf("Car %d", carID)
+}
+
+// serveTrailExport downloads drives as GPX, KML or GeoJSON, e.g.
+// /export/gpx?since=2024-05-01T00:00:00Z or /cars/2/export/kml?segment=1714550400
+func serveTrailExport(w http.ResponseWriter, r *http.Request) {
+	cfg := getConfig()
+	if !cfg.MapEnabled {
+		http.Error(w, "Map is disabled in configuration.", http.StatusForbidden)
+		return
+	}
+
+	format, ok := exportFormats[r.PathValue("format")]
+	if !ok {
+		http.Error(w, "Unknown export format, use gpx, kml or geojson", http.StatusNotFound)
+		return
+	}
+	carID, err := requestedCarID(r)
+	if err != nil {
+		http.Error(w, "Invalid car parameter", http.StatusBadRequest)
+		return
+	}
+	filter, err := parseTrailFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeTrail(w, r, cfg, &filter) {
+		return
+	}
+
+	export := trackExport{
+		Name:   exportName(carID),
+		CarID:  carID,
+		Tracks: exportTracks(getTrail(carID, filter), filter, cfg.PrivacyZones),
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(export, r.PathValue("format"))))
+	if err := format.write(w, export); err != nil {
+		log.Printf("Error writing %s export: %v", r.PathValue("format"), err)
+	}
+}
+
+// runExportCommand implements "tesla-location-server export", which writes
+// drives from TRAIL_FILE without starting the server
+func runExportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	carID := flags.Int("car", 0, "car ID (default: the configured default car)")
+	formatName := flags.String("format", "gpx", "gpx, kml or geojson")
+	since := flags.String("since", "", "start of the range: RFC 3339, Unix seconds or a duration such as 24h")
+	until := flags.String("until", "", "end of the range, same formats as -since")
+	segment := flags.Int64("segment", 0, "export a single drive, see -list")
+	path := flags.String("trail", trailFile, "trail file written by the server (TRAIL_FILE)")
+	output := flags.String("o", "", "output file (default: stdout)")
+	list := flags.Bool("list", false, "list the recorded drives instead of exporting")
+	noPrivacy := flags.Bool("no-privacy", false, "include positions inside privacy zones")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: tesla-location-server export [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	format, ok := exportFormats[*formatName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown format %q, use gpx, kml or geojson\n", *formatName)
+		return 2
+	}
+	if *path == "" {
+		fmt.Fprintln(os.Stderr, "No trail file, set TRAIL_FILE or pass -trail")
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+	if *carID == 0 {
+		*carID = cfg.DefaultCarID
+	}
+	zones := cfg.PrivacyZones
+	if *noPrivacy {
+		zones = nil
+	}
+
+	filter := trailFilter{Segment: *segment}
+	if filter.Since, err = parseTrailTime(*since); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if filter.Until, err = parseTrailTime(*until); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	trailMaxPoints = max(trailMaxPoints, 1000000) // The file may hold more than the server keeps
+	if _, err := readTrailFile(*path); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read trail: %v\n", err)
+		return 1
+	}
+
+	export := trackExport{
+		Name:   fmt.Sprintf("Car %d", *carID),
+		CarID:  *carID,
+		Tracks: exportTracks(getTrail(*carID, filter), filter, zones),
+	}
+
+	if *list {
+		for _, track := range export.Tracks {
+			fmt.Printf("%d\t%s\t%d points\n", track[0].Segment, trackName(track), len(track))
+		}
+		return 0
+	}
+
+	if *output == "" {
+		if err := format.write(os.Stdout, export); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write export: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if err := writeExportFile(*output, format, export); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write export: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d tracks to %s\n", len(export.Tracks), *output)
+	return 0
+}
+
+// writeExportFile writes the export to path. Close is checked, since a full
+// disk may only show up when the last buffered data is flushed.
+func writeExportFile(path string, format exportFormat, export trackExport) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := format.write(file, export); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testExport() trackExport {
+	start := time.Date(2024, 5, 1, 8, 15, 0, 0, time.UTC)
+	point := func(minute int, lat float64, speed float64) TrailPoint {
+		return TrailPoint{
+			CarID: 1, Time: start.Add(time.Duration(minute) * time.Minute),
+			Latitude: lat, Longitude: 115.8, Speed: speed, Heading: 180, Elevation: 20 + float64(minute),
+			State: "driving", Segment: start.Unix(),
+		}
+	}
+	return trackExport{Name: "Car 1", CarID: 1, Tracks: [][]TrailPoint{{point(0, -32.30, 36), point(1, -32.31, 72)}}}
+}
+
+func TestWriteGPX(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeGPX(&out, testExport()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `<TrackPointExtension xmlns="`+gpxtpxNamespace+`">`) {
+		t.Errorf("TrackPointExtension is not in Garmin's namespace:\n%s", out.String())
+	}
+
+	// Read it back the way a namespace aware GPX reader would
+	var gpx struct {
+		XMLName xml.Name `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+		Points  []struct {
+			Latitude  float64 `xml:"lat,attr"`
+			Elevation float64 `xml:"ele"`
+			Time      string  `xml:"time"`
+			Extension struct {
+				Speed  float64 `xml:"speed"`
+				Course float64 `xml:"course"`
+			} `xml:"extensions>TrackPointExtension"`
+		} `xml:"trk>trkseg>trkpt"`
+	}
+	if err := xml.Unmarshal(out.Bytes(), &gpx); err != nil {
+		t.Fatal(err)
+	}
+	if len(gpx.Points) != 2 {
+		t.Fatalf("%d track points, want 2", len(gpx.Points))
+	}
+	second := gpx.Points[1]
+	if second.Latitude != -32.31 || second.Elevation != 21 || second.Time != "2024-05-01T08:16:00Z" {
+		t.Errorf("second point = %+v", second)
+	}
+	if second.Extension.Speed != 20 || second.Extension.Course != 180 {
+		t.Errorf("speed %v m/s, course %v, want 20 m/s (72 km/h) and 180", second.Extension.Speed, second.Extension.Course)
+	}
+}
+
+func TestWriteKML(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeKML(&out, testExport()); err != nil {
+		t.Fatal(err)
+	}
+	var kml struct {
+		Placemarks []struct {
+			Begin       string `xml:"TimeSpan>begin"`
+			End         string `xml:"TimeSpan>end"`
+			Coordinates string `xml:"LineString>coordinates"`
+		} `xml:"Document>Placemark"`
+	}
+	if err := xml.Unmarshal(out.Bytes(), &kml); err != nil {
+		t.Fatal(err)
+	}
+	if len(kml.Placemarks) != 1 {
+		t.Fatalf("%d placemarks, want 1", len(kml.Placemarks))
+	}
+	placemark := kml.Placemarks[0]
+	if placemark.Coordinates != "115.800000,-32.300000,20.0 115.800000,-32.310000,21.0" {
+		t.Errorf("coordinates = %q, want lon,lat,elevation", placemark.Coordinates)
+	}
+	if placemark.Begin != "2024-05-01T08:15:00Z" || placemark.End != "2024-05-01T08:16:00Z" {
+		t.Errorf("time span = %s to %s", placemark.Begin, placemark.End)
+	}
+}
+
+func TestWriteGeoJSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeGeoJSON(&out, testExport()); err != nil {
+		t.Fatal(err)
+	}
+	var collection struct {
+		Features []struct {
+			Geometry struct {
+				Type        string      `json:"type"`
+				Coordinates [][]float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties struct {
+				State      string  `json:"state"`
+				DistanceKm float64 `json:"distance_km"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &collection); err != nil {
+		t.Fatal(err)
+	}
+	if len(collection.Features) != 1 {
+		t.Fatalf("%d features, want 1", len(collection.Features))
+	}
+	feature := collection.Features[0]
+	if feature.Geometry.Type != "LineString" || len(feature.Geometry.Coordinates) != 2 || feature.Geometry.Coordinates[0][0] != 115.8 {
+		t.Errorf("geometry = %+v, want a LineString of [lon, lat, elevation]", feature.Geometry)
+	}
+	if feature.Properties.State != "driving" || feature.Properties.DistanceKm < 1.1 || feature.Properties.DistanceKm > 1.12 {
+		t.Errorf("properties = %+v, want a drive of about 1.11 km", feature.Properties)
+	}
+}
+
+func TestExportTracksSkipsStops(t *testing.T) {
+	export := testExport()
+	drive := export.Tracks[0]
+	stop := []TrailPoint{drive[1], drive[1]}
+	for i := range stop {
+		stop[i].State = "online"
+		stop[i].Segment++
+	}
+	points := append(append([]TrailPoint{}, drive...), stop...)
+
+	if tracks := exportTracks(points, trailFilter{}, nil); len(tracks) != 1 || tracks[0][0].State != "driving" {
+		t.Errorf("tracks = %+v, want only the drive", tracks)
+	}
+	// getTrail does the filtering, a chosen segment only makes exportTracks keep stops
+	if tracks := exportTracks(points, trailFilter{Segment: stop[0].Segment}, nil); len(tracks) != 2 {
+		t.Errorf("%d tracks with a segment chosen, want stops kept", len(tracks))
+	}
+}
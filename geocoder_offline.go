@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	offlineCityRadiusKm  = 30  // Nearest town further than this is not named
+	offlineStateRadiusKm = 300 // Beyond this we don't guess the state either
+)
+
+var errNoNearbyPlace = errors.New("no place in the offline data near this position")
+
+// offlineGeocoder reverse geocodes from a GeoNames dump
+// (https://download.geonames.org/export/dump/). placesFile is a cities file
+// such as cities500.txt; admin1CodesASCII.txt and countryInfo.txt are read
+// from the same directory when present, for state and country names.
+type offlineGeocoder struct {
+	placesFile string
+}
+
+func (offlineGeocoder) Name() string { return providerOffline }
+
+func (g offlineGeocoder) ReverseGeocode(lat, lon float64) (Place, error) {
+	if g.placesFile == "" {
+		return Place{}, fmt.Errorf("no GeoNames file configured")
+	}
+	index, err := loadGeoNames(g.placesFile)
+	if err != nil {
+		return Place{}, err
+	}
+
+	nearest, distance := index.nearest(lat, lon, offlineStateRadiusKm, nil)
+	if nearest == nil {
+		return Place{}, errNoNearbyPlace
+	}
+
+	place := Place{
+		State:       index.admin1[nearest.countryCode+"."+nearest.admin1],
+		Country:     index.countries[nearest.countryCode],
+		CountryCode: strings.ToUpper(nearest.countryCode),
+	}
+	if distance <= offlineCityRadiusKm {
+		if nearest.featureCode == "PPLX" {
+			// Sections of a city are suburbs, name the city they belong to as well
+			place.Suburb = nearest.name
+			if city, _ := index.nearest(lat, lon, offlineCityRadiusKm, func(p *geoName) bool { return p.featureCode != "PPLX" }); city != nil {
+				place.City = city.name
+			}
+		} else {
+			place.City = nearest.name
+		}
+	}
+	if place.FormattedName() == "" {
+		return Place{}, errNoNearbyPlace
+	}
+	return place, nil
+}
+
+type geoName struct {
+	name        string
+	latitude    float64
+	longitude   float64
+	featureCode string
+	countryCode string
+	admin1      string
+}
+
+// geoNameIndex buckets places into one degree cells so lookups only scan the
+// neighbourhood of the car
+type geoNameIndex struct {
+	cells     map[[2]int][]*geoName
+	admin1    map[string]string // "AU.08" -> "Western Australia"
+	countries map[string]string // "AU" -> "Australia"
+}
+
+var (
+	geoNamesCache = map[string]*geoNameIndex{}
+	geoNamesMutex sync.Mutex
+)
+
+func geoNameCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat)), int(math.Floor(lon))}
+}
+
+// loadGeoNames parses the GeoNames files once and keeps them in memory
+func loadGeoNames(path string) (*geoNameIndex, error) {
+	geoNamesMutex.Lock()
+	defer geoNamesMutex.Unlock()
+
+	if index, ok := geoNamesCache[path]; ok {
+		return index, nil
+	}
+
+	index := &geoNameIndex{cells: make(map[[2]int][]*geoName)}
+	count := 0
+	err := readGeoNamesTSV(path, func(fields []string) {
+		// geonameid, name, asciiname, alternatenames, latitude, longitude,
+		// feature class, feature code, country code, cc2, admin1 code, ...
+		if len(fields) < 11 || fields[6] != "P" {
+			return
+		}
+		switch fields[7] {
+		case "PPLH", "PPLQ", "PPLW": // Historical, abandoned and destroyed places
+			return
+		}
+		lat, latErr := strconv.ParseFloat(fields[4], 64)
+		lon, lonErr := strconv.ParseFloat(fields[5], 64)
+		if latErr != nil || lonErr != nil {
+			return
+		}
+		place := &geoName{
+			name:        fields[1],
+			latitude:    lat,
+			longitude:   lon,
+			featureCode: fields[7],
+			countryCode: fields[8],
+			admin1:      fields[10],
+		}
+		cell := geoNameCell(lat, lon)
+		index.cells[cell] = append(index.cells[cell], place)
+		count++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(path)
+	index.admin1 = readGeoNamesLookup(filepath.Join(dir, "admin1CodesASCII.txt"), 0, 1)
+	index.countries = readGeoNamesLookup(filepath.Join(dir, "countryInfo.txt"), 0, 4)
+
+	log.Printf("Loaded %d places, %d states and %d countries from GeoNames data in %s", count, len(index.admin1), len(index.countries), dir)
+	geoNamesCache[path] = index
+	return index, nil
+}
+
+// readGeoNamesTSV calls fn with the columns of every non-comment line
+func readGeoNamesTSV(path string, fn func(fields []string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024) // Alternate names can make lines long
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, "\t"))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	return nil
+}
+
+// readGeoNamesLookup maps one column to another, the files are optional
+func readGeoNamesLookup(path string, keyColumn, valueColumn int) map[string]string {
+	values := make(map[string]string)
+	err := readGeoNamesTSV(path, func(fields []string) {
+		if len(fields) > keyColumn && len(fields) > valueColumn {
+			values[fields[keyColumn]] = fields[valueColumn]
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error reading %s: %v", path, err)
+	}
+	return values
+}
+
+// nearest finds the closest place within maxKm that passes the filter (nil accepts all)
+func (index *geoNameIndex) nearest(lat, lon, maxKm float64, filter func(*geoName) bool) (*geoName, float64) {
+	latSpan := int(math.Ceil(maxKm / 111))
+	lonSpan := 180
+	if cos := math.Cos(lat * math.Pi / 180); cos > 0.01 {
+		lonSpan = min(int(math.Ceil(maxKm/(111*cos))), 180)
+	}
+
+	var best *geoName
+	bestDistance := maxKm
+	centre := geoNameCell(lat, lon)
+	for dLat := -latSpan; dLat <= latSpan; dLat++ {
+		for dLon := -lonSpan; dLon <= lonSpan; dLon++ {
+			// Wrap across the antimeridian
+			cellLon := (centre[1]+dLon+180+360)%360 - 180
+			for _, place := range index.cells[[2]int{centre[0] + dLat, cellLon}] {
+				if filter != nil && !filter(place) {
+					continue
+				}
+				if distance := calculateDistance(lat, lon, place.latitude, place.longitude); distance <= bestDistance {
+					best, bestDistance = place, distance
+				}
+			}
+		}
+	}
+	return best, bestDistance
+}
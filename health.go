@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Readiness check results, the worst one decides the overall status
+const (
+	healthOK   = "ok"
+	healthWarn = "warn" // Reported as "degraded" overall, still HTTP 200
+	healthFail = "fail" // HTTP 503
+)
+
+var serverStartedAt = time.Now()
+
+// ReadinessCheck is one line of the /readyz report
+type ReadinessCheck struct {
+	Name    string  `json:"name"` // "mqtt", "car 1" or "<kind> provider"
+	Status  string  `json:"status"`
+	Message string  `json:"message"`
+	Age     float64 `json:"age_seconds,omitempty"` // Since the last message, position or provider failure
+}
+
+// Readiness is served by /readyz
+type Readiness struct {
+	Status            string           `json:"status"` // "ok", "degraded" or "fail"
+	StaleAfterSeconds int              `json:"stale_after_seconds"`
+	Checks            []ReadinessCheck `json:"checks"`
+}
+
+// serveHealthz only says the process is up and serving, for systemd and container health checks
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         healthOK,
+		"uptime_seconds": time.Since(serverStartedAt).Seconds(),
+	})
+}
+
+// serveReadyz reports whether the server has live data to show: 200 when every
+// check passes or only warns, 503 when one fails
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness := checkReadiness(getConfig())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if readiness.Status == healthFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(readiness)
+}
+
+func checkReadiness(cfg Config) Readiness {
+	readiness := Readiness{StaleAfterSeconds: cfg.LocationStaleAfter}
+	readiness.Checks = append(readiness.Checks, checkMQTT())
+	readiness.Checks = append(readiness.Checks, checkCars(cfg)...)
+	readiness.Checks = append(readiness.Checks, checkProviders(cfg)...)
+
+	readiness.Status = healthOK
+	for _, check := range readiness.Checks {
+		switch {
+		case check.Status == healthFail:
+			readiness.Status = healthFail
+		case check.Status == healthWarn && readiness.Status == healthOK:
+			readiness.Status = "degraded"
+		}
+	}
+	return readiness
+}
+
+func checkMQTT() ReadinessCheck {
+	status := getMQTTStatus()
+	check := ReadinessCheck{Name: "mqtt", Status: healthOK, Age: max(secondsSince(status.LastMessageAt), 0)}
+	switch {
+	case !status.Connected && status.LastError != "":
+		check.Status, check.Message = healthFail, "disconnected from "+status.Broker+": "+status.LastError
+	case !status.Connected:
+		check.Status, check.Message = healthFail, "not connected to "+status.Broker
+	case status.LastMessageAt.IsZero():
+		check.Message = "connected to " + status.Broker + ", no messages yet"
+	default:
+		check.Message = "connected to " + status.Broker
+	}
+	return check
+}
+
+// checkCars compares every car's last position against Config.LocationStaleAfter.
+// A parked car stops reporting its position, so staleness only fails readiness
+// while the car says it is driving and warns otherwise.
+func checkCars(cfg Config) []ReadinessCheck {
+	locationMutex.RLock()
+	snapshot := make([]Location, 0, len(cars))
+	for _, loc := range cars {
+		snapshot = append(snapshot, *loc)
+	}
+	locationMutex.RUnlock()
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].CarID < snapshot[j].CarID })
+
+	var checks []ReadinessCheck
+	seenDefault := false
+	for _, loc := range snapshot {
+		seenDefault = seenDefault || loc.CarID == cfg.DefaultCarID
+		checks = append(checks, checkCar(loc, cfg.LocationStaleAfter))
+	}
+	if !seenDefault {
+		checks = append(checks, ReadinessCheck{
+			Name:    fmt.Sprintf("car %d", cfg.DefaultCarID),
+			Status:  healthWarn,
+			Message: "the default car has not published anything",
+		})
+	}
+	return checks
+}
+
+func checkCar(loc Location, staleAfter int) ReadinessCheck {
+	check := ReadinessCheck{Name: fmt.Sprintf("car %d", loc.CarID), Status: healthOK}
+	if loc.UpdatedAt.IsZero() {
+		check.Status, check.Message = healthWarn, "no position yet"
+		return check
+	}
+
+	age := time.Since(loc.UpdatedAt)
+	check.Age = age.Seconds()
+	check.Message = fmt.Sprintf("position %s old, state %s", age.Round(time.Second), loc.State)
+	if staleAfter > 0 && age > time.Duration(staleAfter)*time.Second {
+		check.Status = healthWarn
+		if loc.State == "driving" {
+			check.Status = healthFail
+		}
+		check.Message = fmt.Sprintf("position is stale: %s old (limit %ds), state %s", age.Round(time.Second), staleAfter, loc.State)
+	}
+	return check
+}
+
+// checkProviders reports the configured geocoder, weather and time zone
+// providers from their most recent requests, nothing is sent to them. Lookups
+// fall back to cached or offline data, so a failing provider only warns.
+func checkProviders(cfg Config) []ReadinessCheck {
+	providers := []struct{ kind, name string }{
+		{lookupLocation, currentGeocoder(cfg).Name()},
+		{lookupWeather, currentWeatherProvider(cfg).Name()},
+		{lookupTimezone, currentTimezoneResolver(cfg).Name()},
+	}
+
+	var checks []ReadinessCheck
+	for _, provider := range providers {
+		check := ReadinessCheck{Name: provider.kind + " provider", Status: healthOK}
+		stats, ok := getProviderMetrics(provider.kind, provider.name)
+		switch {
+		case !ok:
+			check.Message = provider.name + ": no requests yet"
+		case stats.LastErrorAt.After(stats.LastSuccessAt):
+			check.Status = healthWarn
+			check.Age = time.Since(stats.LastErrorAt).Seconds()
+			check.Message = fmt.Sprintf("%s: last request failed: %s", provider.name, stats.LastError)
+		default:
+			check.Message = fmt.Sprintf("%s: %d requests, %d failed", provider.name, stats.Requests, stats.Errors)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
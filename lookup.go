@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Lookup kinds, each with its own cache policy and rate limit
+const (
+	lookupLocation = "location"
+	lookupTimezone = "timezone"
+	lookupWeather  = "weather"
+)
+
+type lookupPolicy struct {
+	TTL      time.Duration // How long a result is served from cache
+	Grid     float64       // Coordinates are rounded to this many degrees before lookup
+	Rate     float64       // Requests per second allowed to the provider
+	Burst    int           // Requests allowed back to back
+	MaxWait  time.Duration // Longest a lookup waits for the rate limiter
+	StaleFor time.Duration // Expired results are still served for this long when the provider fails
+}
+
+var lookupPolicies = map[string]lookupPolicy{
+	// Nominatim's usage policy allows at most 1 request per second. 0.001° is roughly 100 m.
+	lookupLocation: {TTL: time.Hour, Grid: 0.001, Rate: 1, Burst: 1, MaxWait: 3 * time.Second, StaleFor: 24 * time.Hour},
+	// Zones rarely change, only the zone is cached and the clock is computed locally. 0.05° is roughly 5 km.
+	lookupTimezone: {TTL: 24 * time.Hour, Grid: 0.05, Rate: 1, Burst: 1, MaxWait: 3 * time.Second, StaleFor: 7 * 24 * time.Hour},
+	// Open-Meteo data updates every 15 minutes. 0.01° is roughly 1 km.
+	lookupWeather: {TTL: 10 * time.Minute, Grid: 0.01, Rate: 5, Burst: 5, MaxWait: 3 * time.Second, StaleFor: time.Hour},
+}
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+// Providers answering from local data skip the rate limiter
+var localProviders = map[string]bool{
+	providerFake:    true,
+	providerOffline: true,
+}
+
+// CacheStats is reported per lookup kind on the admin page
+type CacheStats struct {
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Coalesced   int64 `json:"coalesced"`    // Misses answered by a request already in flight
+	StaleServed int64 `json:"stale_served"` // Expired entries served because the provider failed
+	RateLimited int64 `json:"rate_limited"`
+	Errors      int64 `json:"errors"`
+	Entries     int   `json:"entries"`
+}
+
+type cacheEntry struct {
+	value   interface{}
+	fetched time.Time
+}
+
+// lookupCache sits in front of the geocoding, weather and timezone providers.
+// Results are keyed on a rounded coordinate grid, concurrent misses for the same
+// key share one request, and requests to each provider go through a token bucket.
+type lookupCache struct {
+	mutex    sync.Mutex
+	entries  map[string]cacheEntry
+	stats    map[string]*CacheStats
+	limiters map[string]*tokenBucket
+	inflight singleflight.Group
+}
+
+var lookups = newLookupCache()
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func newLookupCache() *lookupCache {
+	c := &lookupCache{
+		entries:  map[string]cacheEntry{},
+		stats:    map[string]*CacheStats{},
+		limiters: map[string]*tokenBucket{},
+	}
+	for kind, policy := range lookupPolicies {
+		c.stats[kind] = &CacheStats{}
+		c.limiters[kind] = newTokenBucket(policy.Rate, policy.Burst)
+	}
+	return c
+}
+
+func roundToGrid(value, grid float64) float64 {
+	return math.Round(value/grid) * grid
+}
+
+// get returns the cached value for the grid cell containing lat/lon, calling fetch
+// with the cell's coordinates on a miss. variant separates results that depend on
+// more than the position, such as the unit system for weather.
+func (c *lookupCache) get(kind, provider string, lat, lon float64, variant string, fetch func(lat, lon float64) (interface{}, error)) (interface{}, error) {
+	policy := lookupPolicies[kind]
+	lat = roundToGrid(lat, policy.Grid)
+	lon = roundToGrid(lon, policy.Grid)
+	key := fmt.Sprintf("%s|%s|%s|%.4f|%.4f", kind, provider, variant, lat, lon)
+
+	c.mutex.Lock()
+	entry, cached := c.entries[key]
+	if cached && time.Since(entry.fetched) < policy.TTL {
+		c.stats[kind].Hits++
+		c.mutex.Unlock()
+		return entry.value, nil
+	}
+	c.stats[kind].Misses++
+	c.mutex.Unlock()
+
+	// Only the caller whose function runs is the leader, everyone else shares its result
+	leader := false
+	value, err, _ := c.inflight.Do(key, func() (interface{}, error) {
+		leader = true
+		if !localProviders[provider] && !c.limiters[kind].wait(policy.MaxWait) {
+			return nil, errRateLimited
+		}
+		start := time.Now()
+		value, err := fetch(lat, lon)
+		recordProviderRequest(kind, provider, time.Since(start), err)
+		return value, err
+	})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats[kind]
+	if !leader {
+		stats.Coalesced++
+	}
+
+	if err != nil {
+		if errors.Is(err, errRateLimited) {
+			stats.RateLimited++
+		} else {
+			stats.Errors++
+		}
+		// A stale answer beats no answer on patchy mobile data
+		if cached && time.Since(entry.fetched) < policy.TTL+policy.StaleFor {
+			stats.StaleServed++
+			return entry.value, nil
+		}
+		return nil, err
+	}
+
+	c.entries[key] = cacheEntry{value: value, fetched: time.Now()}
+	c.pruneLocked()
+	return value, nil
+}
+
+// pruneLocked drops entries past their stale window once the cache grows large
+func (c *lookupCache) pruneLocked() {
+	if len(c.entries) < 5000 {
+		return
+	}
+	for key, entry := range c.entries {
+		policy := lookupPolicies[lookupKind(key)]
+		if time.Since(entry.fetched) > policy.TTL+policy.StaleFor {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// lookupKind extracts the kind from a cache key
+func lookupKind(key string) string {
+	kind, _, _ := strings.Cut(key, "|")
+	return kind
+}
+
+func (c *lookupCache) snapshot() map[string]CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries := map[string]int{}
+	for key := range c.entries {
+		entries[lookupKind(key)]++
+	}
+
+	result := map[string]CacheStats{}
+	for kind, stats := range c.stats {
+		snapshot := *stats
+		snapshot.Entries = entries[kind]
+		result[kind] = snapshot
+	}
+	return result
+}
+
+func (c *lookupCache) clear() {
+	c.mutex.Lock()
+	c.entries = map[string]cacheEntry{}
+	c.mutex.Unlock()
+}
+
+// tokenBucket is a minimal token bucket rate limiter
+type tokenBucket struct {
+	mutex    sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, capacity: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait takes a token, sleeping until one is available. It gives up without
+// taking a token if that would mean waiting longer than maxWait.
+func (b *tokenBucket) wait(maxWait time.Duration) bool {
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	delay := time.Duration(0)
+	if b.tokens < 1 {
+		delay = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		if delay > maxWait {
+			b.mutex.Unlock()
+			return false
+		}
+	}
+	// Reserve the token now so concurrent callers queue up behind us
+	b.tokens--
+	b.mutex.Unlock()
+
+	time.Sleep(delay)
+	return true
+}
+
+// fetchJSON performs a GET with a timeout and decodes the JSON response
+func fetchJSON(url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	// Nominatim's usage policy requires an identifying User-Agent
+	req.Header.Set("User-Agent", "obs-teslamate/1.0 (+https://github.com/nmanzi/obs-teslamate)")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d from %s", resp.StatusCode, req.URL.Host)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func serveAdminCacheStats(w http.ResponseWriter, r *http.Request) {
+	if !requireAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "DELETE":
+		lookups.clear()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lookups.snapshot())
+}
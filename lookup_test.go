@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFetch wraps a provider call and counts how often it reaches the provider
+func countingFetch(calls *int32, fetch func(lat, lon float64) (interface{}, error)) func(lat, lon float64) (interface{}, error) {
+	return func(lat, lon float64) (interface{}, error) {
+		atomic.AddInt32(calls, 1)
+		return fetch(lat, lon)
+	}
+}
+
+func fakePlace(lat, lon float64) (interface{}, error) {
+	return fakeGeocoder{}.ReverseGeocode(lat, lon)
+}
+
+func TestLookupCacheHitsWithinGridCell(t *testing.T) {
+	c := newLookupCache()
+	var calls int32
+	fetch := countingFetch(&calls, fakePlace)
+
+	// 0.001° grid: the first two round to the same cell, the third doesn't
+	for _, position := range [][2]float64{{-32.3510, 115.8120}, {-32.3511, 115.8121}, {-32.3530, 115.8120}} {
+		value, err := c.get(lookupLocation, providerFake, position[0], position[1], "", fetch)
+		if err != nil {
+			t.Fatalf("get(%v): %v", position, err)
+		}
+		if place := value.(Place); place.CountryCode != "TL" {
+			t.Errorf("get(%v) = %+v, want the fake place", position, place)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("provider called %d times, want 2", calls)
+	}
+	stats := c.snapshot()[lookupLocation]
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Entries != 2 {
+		t.Errorf("stats = %+v, want 1 hit, 2 misses and 2 entries", stats)
+	}
+}
+
+func TestLookupCacheVariants(t *testing.T) {
+	c := newLookupCache()
+	var calls int32
+	for _, units := range []string{unitsMetric, unitsImperial, unitsMetric} {
+		system := unitsFor(units)
+		value, err := c.get(lookupWeather, providerFake, -32.35, 115.81, units, countingFetch(&calls, func(lat, lon float64) (interface{}, error) {
+			return fakeWeatherProvider{}.CurrentWeather(lat, lon, system)
+		}))
+		if err != nil {
+			t.Fatalf("get(%s): %v", units, err)
+		}
+		if weather := value.(WeatherData); weather.TemperatureUnit != system.Temperature {
+			t.Errorf("get(%s) temperature unit = %q, want %q", units, weather.TemperatureUnit, system.Temperature)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("provider called %d times, want once per unit system", calls)
+	}
+}
+
+func TestLookupCacheTTL(t *testing.T) {
+	c := newLookupCache()
+	var calls int32
+	failing := false
+	fetch := countingFetch(&calls, func(lat, lon float64) (interface{}, error) {
+		if failing {
+			return nil, errors.New("provider down")
+		}
+		return fakePlace(lat, lon)
+	})
+
+	// ages every cached entry as if it was fetched that long ago
+	age := func(d time.Duration) {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		for key, entry := range c.entries {
+			entry.fetched = time.Now().Add(-d)
+			c.entries[key] = entry
+		}
+	}
+	get := func() error {
+		_, err := c.get(lookupLocation, providerFake, -32.35, 115.81, "", fetch)
+		return err
+	}
+
+	policy := lookupPolicies[lookupLocation]
+	if err := get(); err != nil {
+		t.Fatal(err)
+	}
+	age(policy.TTL + time.Minute)
+	if err := get(); err != nil || calls != 2 {
+		t.Fatalf("expired entry: err = %v, calls = %d, want a second fetch", err, calls)
+	}
+
+	// Expired but within the stale window, a failing provider is covered by the old answer
+	failing = true
+	age(policy.TTL + time.Minute)
+	if err := get(); err != nil {
+		t.Errorf("stale entry with a failing provider: %v", err)
+	}
+	if stats := c.snapshot()[lookupLocation]; stats.StaleServed != 1 || stats.Errors != 1 {
+		t.Errorf("stats = %+v, want 1 stale answer and 1 error", stats)
+	}
+
+	age(policy.TTL + policy.StaleFor + time.Minute)
+	if err := get(); err == nil {
+		t.Error("entry past its stale window was served")
+	}
+}
+
+func TestLookupCacheRateLimit(t *testing.T) {
+	c := newLookupCache()
+	// One token, refilled far slower than MaxWait
+	c.limiters[lookupLocation] = newTokenBucket(0.01, 1)
+	var calls int32
+	fetch := countingFetch(&calls, fakePlace)
+
+	if _, err := c.get(lookupLocation, "remote", -32.35, 115.81, "", fetch); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := c.get(lookupLocation, "remote", -33.35, 115.81, "", fetch); !errors.Is(err, errRateLimited) {
+		t.Errorf("second request: err = %v, want errRateLimited", err)
+	}
+	if calls != 1 {
+		t.Errorf("provider called %d times, want 1", calls)
+	}
+	if stats := c.snapshot()[lookupLocation]; stats.RateLimited != 1 {
+		t.Errorf("stats = %+v, want 1 rate limited", stats)
+	}
+
+	// Local providers skip the limiter
+	for i := 0; i < 3; i++ {
+		if _, err := c.get(lookupLocation, providerFake, -34+float64(i), 115.81, "", fetch); err != nil {
+			t.Errorf("fake provider request %d: %v", i, err)
+		}
+	}
+}
+
+func TestLookupCacheCoalescesConcurrentMisses(t *testing.T) {
+	c := newLookupCache()
+	var calls int32
+	release := make(chan struct{})
+	fetch := countingFetch(&calls, func(lat, lon float64) (interface{}, error) {
+		<-release
+		return fakePlace(lat, lon)
+	})
+
+	const callers = 5
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.get(lookupLocation, providerFake, -32.35, 115.81, "", fetch); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// Let every caller reach the in-flight request before it completes
+	for c.snapshot()[lookupLocation].Misses < callers {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("provider called %d times, want 1", calls)
+	}
+	if stats := c.snapshot()[lookupLocation]; stats.Coalesced != callers-1 {
+		t.Errorf("stats = %+v, want %d coalesced", stats, callers-1)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(100, 2)
+	for i := 0; i < 2; i++ {
+		if !b.wait(0) {
+			t.Fatalf("burst token %d refused", i)
+		}
+	}
+	if b.wait(0) {
+		t.Error("token granted beyond the burst without waiting")
+	}
+	start := time.Now()
+	if !b.wait(time.Second) {
+		t.Fatal("token refused although one is due within a second")
+	}
+	if waited := time.Since(start); waited < 5*time.Millisecond {
+		t.Errorf("waited %v for a token at 100/s, want about 10ms", waited)
+	}
+}
@@ -7,8 +7,10 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,7 +33,11 @@ type ActiveRoute struct {
 	Error string `json:"error"`
 }
 
+// Location is the latest state of a car. Speed, Range and Elevation are stored in
+// Teslamate's units (km/h, km, m); published copies convert them with applyUnits.
 type Location struct {
+	CarID                int       `json:"car_id"`
+	DisplayName          string    `json:"display_name"`
 	Latitude             float64   `json:"latitude"`
 	Longitude            float64   `json:"longitude"`
 	Speed                float64   `json:"speed"`
@@ -46,14 +52,48 @@ type Location struct {
 	MinutesToArrival     float64   `json:"minutes_to_arrival"`
 	MilesToArrival       float64   `json:"miles_to_arrival"`
 	EnergyAtArrival      int       `json:"energy_at_arrival"`
+	PrivacyZone          string    `json:"privacy_zone,omitempty"`
 	UpdatedAt            time.Time `json:"updated_at"`
+
+	// Charging values as published by Teslamate
+	PluggedIn            bool    `json:"plugged_in"`
+	ChargerPower         float64 `json:"charger_power"`          // kW
+	ChargeEnergyAdded    float64 `json:"charge_energy_added"`    // kWh in the current or last charge
+	TimeToFullCharge     float64 `json:"time_to_full_charge"`    // Hours until the charge limit is reached
+	ChargeLimitSoc       float64 `json:"charge_limit_soc"`       // %
+	ChargerActualCurrent float64 `json:"charger_actual_current"` // A
+	ChargerVoltage       float64 `json:"charger_voltage"`        // V
+
+	// Explicit unit fields, always present regardless of the configured units
+	SpeedKmh    float64    `json:"speed_kmh"`
+	SpeedMph    float64    `json:"speed_mph"`
+	RangeKm     float64    `json:"range_km"`
+	RangeMi     float64    `json:"range_mi"`
+	ElevationM  float64    `json:"elevation_m"`
+	ElevationFt float64    `json:"elevation_ft"`
+	KmToArrival float64    `json:"km_to_arrival"`
+	Units       UnitSystem `json:"units"`
+
+	// Current or last trip, see trip.go
+	Trip *TripStats `json:"trip,omitempty"`
+
+	// Current charge, or the last one shortly after it ended, see charging.go
+	Charging *ChargingSession `json:"charging,omitempty"`
+
+	// Set by applyPrivacy when it withholds the coordinates, never published
+	lookupLatitude, lookupLongitude float64
+
+	// An elevation has been received, so 0 m is sea level rather than unknown
+	hasElevation bool
 }
 
 type WeatherData struct {
-	Temperature float64 `json:"temperature"`
-	Description string  `json:"description"`
-	Humidity    int     `json:"humidity"`
-	WindSpeed   float64 `json:"wind_speed"`
+	Temperature     float64 `json:"temperature"`
+	TemperatureUnit string  `json:"temperature_unit"`
+	Description     string  `json:"description"`
+	Humidity        int     `json:"humidity"`
+	WindSpeed       float64 `json:"wind_speed"`
+	WindSpeedUnit   string  `json:"wind_speed_unit"`
 }
 
 type Config struct {
@@ -62,19 +102,100 @@ type Config struct {
 	MapEnabled      bool   `json:"map_enabled"`
 	OverlayEnabled  bool   `json:"overlay_enabled"`
 	TimeZoneDBToken string `json:"timezonedb_token"`
+	DefaultCarID    int    `json:"default_car_id"`
+
+	PrivacyZones []PrivacyZone `json:"privacy_zones"`
+
+	HomeLabel       string           `json:"home_label"`
+	HomeLatitude    float64          `json:"home_latitude"`
+	HomeLongitude   float64          `json:"home_longitude"`
+	ReferencePoints []ReferencePoint `json:"reference_points"`
+
+	Units string `json:"units"` // metric, imperial or uk
+
+	// External providers, see providers.go
+	Geocoder             string `json:"geocoder"`      // nominatim, photon, offline or fake
+	GeocoderURL          string `json:"geocoder_url"`  // Self-hosted Nominatim/Photon base URL
+	GeoNamesFile         string `json:"geonames_file"` // GeoNames cities dump for offline geocoding and fallback
+	WeatherProvider      string `json:"weather_provider"`
+	OpenWeatherMapToken  string `json:"openweathermap_token"`
+	TimezoneProvider     string `json:"timezone_provider"`      // auto, timezonedb, offline or fake
+	TimezoneBoundaryFile string `json:"timezone_boundary_file"` // GeoJSON used by the offline resolver
+
+	TripAutoStart     bool `json:"trip_auto_start"`      // Start a trip when the car starts driving
+	TripAutoStopAfter int  `json:"trip_auto_stop_after"` // Minutes without driving before an automatic trip ends, 0 to never
+
+	PublicTrail bool `json:"public_trail"` // Serve /trail without an admin session, limited to the last day
+
+	LocationStaleAfter int `json:"location_stale_after"` // Seconds without a new position before /readyz reports it, 0 to never
+
+	OverlayTemplate string `json:"overlay_template"` // text/template for the overlay, empty for the built-in layout
+
+	// Overlay text files for OBS text sources, see overlay_file.go
+	OverlayFile         string `json:"overlay_file"`          // Full overlay text, empty to disable
+	OverlayFieldDir     string `json:"overlay_field_dir"`     // Directory for location.txt, weather.txt, ..., empty to disable
+	OverlayFileInterval int    `json:"overlay_file_interval"` // Seconds between refreshes, changes are also written as they arrive
+
+	OverlayImage OverlayImageOptions `json:"overlay_image"` // Defaults for /overlay.png and /overlay.svg
+
+	// OBS WebSocket v5, see obs.go
+	OBSURL      string    `json:"obs_url"` // e.g. ws://localhost:4455, empty to disable
+	OBSPassword string    `json:"obs_password"`
+	OBSRules    []OBSRule `json:"obs_rules"`
+
+	// Outgoing webhooks for car events, see webhooks.go
+	Webhooks          []Webhook `json:"webhooks"`
+	WebhookSecret     string    `json:"webhook_secret"`      // Signs every delivery with HMAC-SHA256, empty to not sign
+	BatteryAlertLevel int       `json:"battery_alert_level"` // % below which battery_low fires, 0 to disable
+}
+
+// PublicConfig is the part of Config served to the unauthenticated browser pages.
+// It must never carry secrets: TimeZoneDB stays server-side and only a public
+// (pk.) Mapbox token, which should be URL-restricted in the Mapbox dashboard, is exposed.
+type PublicConfig struct {
+	ShowRoute      bool   `json:"show_route"`
+	MapboxToken    string `json:"mapbox_token"`
+	MapEnabled     bool   `json:"map_enabled"`
+	OverlayEnabled bool   `json:"overlay_enabled"`
+	DefaultCarID   int    `json:"default_car_id"`
+}
+
+// AdminConfig is the admin view of Config. Server-side API keys are write-only,
+// the admin page only learns whether they are set.
+type AdminConfig struct {
+	Config
+	TimeZoneDBTokenSet     bool `json:"timezonedb_token_set"`
+	OpenWeatherMapTokenSet bool `json:"openweathermap_token_set"`
+	OBSPasswordSet         bool `json:"obs_password_set"`
+	WebhookSecretSet       bool `json:"webhook_secret_set"`
+}
+
+// Topics published by Teslamate for every car, subscribed as <prefix>/cars/+/<topic>
+var carTopics = []string{
+	"display_name",
+	"latitude",
+	"longitude",
+	"speed",
+	"heading",
+	"battery_level",
+	"est_battery_range_km",
+	"state",
+	"elevation",
+	"active_route",
+	"plugged_in",
+	"charger_power",
+	"charge_energy_added",
+	"time_to_full_charge",
+	"charge_limit_soc",
+	"charger_actual_current",
+	"charger_voltage",
 }
 
 var (
-	currentLocation Location
-	locationMutex   sync.RWMutex
-	mqttClient      mqtt.Client
-	config          = Config{
-		ShowRoute:       true,
-		OverlayEnabled:  true,
-		MapboxToken:     os.Getenv("MAPBOX_TOKEN"),
-		MapEnabled:      true,
-		TimeZoneDBToken: os.Getenv("TIMEZONEDB_TOKEN"),
-	}
+	cars          = map[int]*Location{}
+	locationMutex sync.RWMutex
+	mqttClient    mqtt.Client
+	config        Config // Guarded by configMutex, use getConfig/updateConfig
 	adminUsername = os.Getenv("ADMIN_USERNAME")
 	adminPassword = os.Getenv("ADMIN_PASSWORD")
 	mqttBroker    = os.Getenv("MQTT_BROKER")
@@ -82,6 +203,27 @@ var (
 )
 
 func main() {
+	// "export" writes recorded drives to a file instead of running the server
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExportCommand(os.Args[2:]))
+	}
+	// "fake-obs" stands in for OBS when trying out OBS rules
+	if len(os.Args) > 1 && os.Args[1] == "fake-obs" {
+		os.Exit(runFakeOBSCommand(os.Args[2:]))
+	}
+
+	// Load configuration: defaults < CONFIG_FILE < environment
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load configuration: ", err)
+	}
+	config = cfg
+
+	// Restore the breadcrumb trail recorded before a restart
+	if err := loadTrail(); err != nil {
+		log.Printf("Failed to load trail: %v", err)
+	}
+
 	// Initialize session store with a random key
 	sessionKey := generateSessionKey()
 	sessionStore = sessions.NewCookieStore(sessionKey)
@@ -93,21 +235,26 @@ func main() {
 		SameSite: http.SameSiteStrictMode,
 	}
 
+	// Keep the overlay text files for OBS up to date
+	go runOverlayFileWriter()
+
+	// Switch OBS scenes and sources as the car's state changes
+	go runOBSConnection()
+
 	// Initialize MQTT connection
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker("tcp://" + mqttBroker)
-	opts.SetClientID("tesla-location-server")
+	opts, err := newMQTTClientOptions()
+	if err != nil {
+		log.Fatal("Invalid MQTT configuration: ", err)
+	}
 	opts.SetDefaultPublishHandler(messagePubHandler)
 	opts.OnConnect = connectHandler
 	opts.OnConnectionLost = connectLostHandler
+	opts.OnReconnecting = reconnectingHandler
+	opts.OnConnectionNotification = connectionNotificationHandler
 
+	// Connection retries happen in the background, topics are subscribed from connectHandler
 	mqttClient = mqtt.NewClient(opts)
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatal(token.Error())
-	}
-
-	// Subscribe to Teslamate MQTT topics
-	subscribeToTopics()
+	mqttClient.Connect()
 
 	// Setup HTTP server
 	http.HandleFunc("/{$}", serveRoot)
@@ -115,11 +262,35 @@ func main() {
 	http.HandleFunc("/local-time", serveLocalTime)
 	http.HandleFunc("/overlay", serveOverlay)
 	http.HandleFunc("/overlay-data", serveOverlayData)
+	http.HandleFunc("/overlay.png", serveOverlayPNG)
+	http.HandleFunc("/overlay.svg", serveOverlaySVG)
+	http.HandleFunc("/events", serveEvents)
+	http.HandleFunc("/trail", serveTrail)
+	http.HandleFunc("/export/{format}", serveTrailExport)
+	http.HandleFunc("/status", serveStatus)
+	http.HandleFunc("/metrics", serveMetrics)
+	http.HandleFunc("/healthz", serveHealthz)
+	http.HandleFunc("/readyz", serveReadyz)
+	http.HandleFunc("/cars", serveCars)
+	http.HandleFunc("/cars/{id}/{$}", serveRoot)
+	http.HandleFunc("/cars/{id}/location", serveLocationJSON)
+	http.HandleFunc("/cars/{id}/events", serveEvents)
+	http.HandleFunc("/cars/{id}/trail", serveTrail)
+	http.HandleFunc("/cars/{id}/export/{format}", serveTrailExport)
+	http.HandleFunc("/cars/{id}/overlay", serveOverlay)
+	http.HandleFunc("/cars/{id}/overlay-data", serveOverlayData)
+	http.HandleFunc("/cars/{id}/overlay.png", serveOverlayPNG)
+	http.HandleFunc("/cars/{id}/overlay.svg", serveOverlaySVG)
 	http.HandleFunc("/config", serveConfig)
 	http.HandleFunc("/admin/login", serveAdminLogin)
 	http.HandleFunc("/admin/logout", serveAdminLogout)
 	http.HandleFunc("/admin", serveAdmin)
 	http.HandleFunc("/admin/config", serveAdminConfig)
+	http.HandleFunc("/admin/cache-stats", serveAdminCacheStats)
+	http.HandleFunc("/admin/trip", serveAdminTrip)
+	http.HandleFunc("/admin/overlay-template", serveAdminOverlayTemplate)
+	http.HandleFunc("/admin/obs", serveAdminOBS)
+	http.HandleFunc("/admin/webhooks", serveAdminWebhooks)
 
 	// Serve static files from public directory
 	http.Handle("/public/", http.StripPrefix("/public/", http.FileServer(http.Dir("./public/"))))
@@ -128,103 +299,254 @@ func main() {
 	log.Println("Main view (map/offline): http://localhost:8081")
 	log.Println("Overlay (live/offline): http://localhost:8081/overlay")
 	log.Println("Admin login: http://localhost:8081/admin/login")
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	log.Fatal(http.ListenAndServe(":8081", countRequests(http.DefaultServeMux)))
 }
 
-func subscribeToTopics() {
-	topics := map[string]byte{
-		"teslamate/cars/1/latitude":             0,
-		"teslamate/cars/1/longitude":            0,
-		"teslamate/cars/1/speed":                0,
-		"teslamate/cars/1/heading":              0,
-		"teslamate/cars/1/battery_level":        0,
-		"teslamate/cars/1/est_battery_range_km": 0,
-		"teslamate/cars/1/state":                0,
-		"teslamate/cars/1/elevation":            0,
-		"teslamate/cars/1/active_route":         0,
-	}
-
-	for topic := range topics {
-		token := mqttClient.Subscribe(topic, 0, messageHandler)
+func subscribeToTopics(client mqtt.Client) {
+	for _, name := range carTopics {
+		topic := mqttTopicPrefix + "/cars/+/" + name
+		token := client.Subscribe(topic, 0, messageHandler)
 		token.Wait()
+		if err := token.Error(); err != nil {
+			log.Printf("Failed to subscribe to %s: %v\n", topic, err)
+			continue
+		}
 		log.Printf("Subscribed to %s\n", topic)
 	}
 }
 
+// parseCarTopic splits a topic such as teslamate/cars/2/latitude into its car ID and topic name
+func parseCarTopic(topic string) (int, string, bool) {
+	rest, ok := strings.CutPrefix(topic, mqttTopicPrefix+"/cars/")
+	if !ok {
+		return 0, "", false
+	}
+
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+
+	carID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", false
+	}
+
+	return carID, parts[1], true
+}
+
 func messageHandler(client mqtt.Client, msg mqtt.Message) {
+	recordMQTTMessage(msg.Topic())
+
+	carID, name, ok := parseCarTopic(msg.Topic())
+	if !ok {
+		return
+	}
+
 	locationMutex.Lock()
 	defer locationMutex.Unlock()
 
-	topic := msg.Topic()
+	// Cars are discovered as soon as Teslamate publishes anything for them
+	loc, exists := cars[carID]
+	if !exists {
+		loc = &Location{CarID: carID}
+		cars[carID] = loc
+		log.Printf("Discovered car %d\n", carID)
+	}
+
 	payload := string(msg.Payload())
+	eventName := "location"
 
-	switch topic {
-	case "teslamate/cars/1/latitude":
+	switch name {
+	case "display_name":
+		loc.DisplayName = payload
+	case "latitude":
 		if lat, err := strconv.ParseFloat(payload, 64); err == nil {
-			currentLocation.Latitude = lat
-			currentLocation.UpdatedAt = time.Now()
+			loc.Latitude = lat
+			loc.UpdatedAt = time.Now()
 		}
-	case "teslamate/cars/1/longitude":
+	case "longitude":
 		if lon, err := strconv.ParseFloat(payload, 64); err == nil {
-			currentLocation.Longitude = lon
-			currentLocation.UpdatedAt = time.Now()
+			loc.Longitude = lon
+			loc.UpdatedAt = time.Now()
 		}
-	case "teslamate/cars/1/speed":
+	case "speed":
 		if speed, err := strconv.ParseFloat(payload, 64); err == nil {
-			currentLocation.Speed = speed
+			loc.Speed = speed
 		}
-	case "teslamate/cars/1/heading":
+	case "heading":
 		if heading, err := strconv.ParseFloat(payload, 64); err == nil {
-			currentLocation.Heading = heading
+			loc.Heading = heading
 		}
-	case "teslamate/cars/1/battery_level":
+	case "battery_level":
 		if battery, err := strconv.ParseFloat(payload, 64); err == nil {
-			currentLocation.Battery = battery
+			checkBatteryLevel(carID, loc.Battery, battery)
+			loc.Battery = battery
 		}
-	case "teslamate/cars/1/est_battery_range_km":
+	case "est_battery_range_km":
 		if rng, err := strconv.ParseFloat(payload, 64); err == nil {
-			currentLocation.Range = rng
+			loc.Range = rng
+		}
+	case "state":
+		if payload == "driving" && loc.State != "driving" && getConfig().TripAutoStart {
+			autoStartTrip(*loc)
+		}
+		previous := loc.State
+		loc.State = payload
+		if payload == "charging" && previous != "charging" {
+			startChargingSession(*loc)
+		} else if previous == "charging" && payload != "charging" {
+			if session, ok := endChargingSession(*loc); ok {
+				emitEvent(eventChargingFinished, carID, map[string]interface{}{
+					"energy_added":     session.EnergyAdded,
+					"start_battery":    session.StartBattery,
+					"battery":          session.Battery,
+					"max_power":        session.MaxPower,
+					"duration_seconds": session.EndedAt.Sub(session.StartedAt).Seconds(),
+				})
+			}
 		}
-	case "teslamate/cars/1/state":
-		currentLocation.State = payload
-	case "teslamate/cars/1/elevation":
+		// A car seen for the first time hasn't changed state, so a restart sends nothing
+		if previous != "" && payload != previous {
+			switch payload {
+			case "driving":
+				emitEvent(eventDriveStarted, carID, nil)
+			case "charging":
+				emitEvent(eventChargingStarted, carID, nil)
+			}
+		}
+	case "elevation":
 		if elevation, err := strconv.ParseFloat(payload, 64); err == nil {
-			currentLocation.Elevation = elevation
+			loc.Elevation = elevation
+			loc.hasElevation = true
+		}
+	case "plugged_in":
+		if pluggedIn, err := strconv.ParseBool(payload); err == nil {
+			loc.PluggedIn = pluggedIn
 		}
-	case "teslamate/cars/1/active_route":
+	case "charger_power":
+		if power, err := strconv.ParseFloat(payload, 64); err == nil {
+			loc.ChargerPower = power
+		}
+	case "charge_energy_added":
+		if energy, err := strconv.ParseFloat(payload, 64); err == nil {
+			loc.ChargeEnergyAdded = energy
+		}
+	case "time_to_full_charge":
+		if hours, err := strconv.ParseFloat(payload, 64); err == nil {
+			loc.TimeToFullCharge = hours
+		}
+	case "charge_limit_soc":
+		if limit, err := strconv.ParseFloat(payload, 64); err == nil {
+			loc.ChargeLimitSoc = limit
+		}
+	case "charger_actual_current":
+		if current, err := strconv.ParseFloat(payload, 64); err == nil {
+			loc.ChargerActualCurrent = current
+		}
+	case "charger_voltage":
+		if voltage, err := strconv.ParseFloat(payload, 64); err == nil {
+			loc.ChargerVoltage = voltage
+		}
+	case "active_route":
 		var route ActiveRoute
 		if err := json.Unmarshal([]byte(payload), &route); err == nil {
 			if route.Error == "" || route.Error == "null" {
 				// Active route available
-				currentLocation.Destination = route.Destination
-				currentLocation.DestinationLatitude = route.Location.Latitude
-				currentLocation.DestinationLongitude = route.Location.Longitude
-				currentLocation.MinutesToArrival = route.MinutesToArrival
-				currentLocation.MilesToArrival = route.MilesToArrival
-				currentLocation.EnergyAtArrival = route.EnergyAtArrival
+				loc.Destination = route.Destination
+				loc.DestinationLatitude = route.Location.Latitude
+				loc.DestinationLongitude = route.Location.Longitude
+				loc.MinutesToArrival = route.MinutesToArrival
+				loc.MilesToArrival = route.MilesToArrival
+				loc.EnergyAtArrival = route.EnergyAtArrival
 			} else {
-				// No active route
-				currentLocation.Destination = ""
-				currentLocation.DestinationLatitude = 0
-				currentLocation.DestinationLongitude = 0
-				currentLocation.MinutesToArrival = 0
-				currentLocation.MilesToArrival = 0
-				currentLocation.EnergyAtArrival = 0
+				// No active route, navigation ending at the destination is an arrival
+				checkArrival(*loc)
+				loc.Destination = ""
+				loc.DestinationLatitude = 0
+				loc.DestinationLongitude = 0
+				loc.MinutesToArrival = 0
+				loc.MilesToArrival = 0
+				loc.EnergyAtArrival = 0
 			}
+			eventName = "route"
 		}
 	}
+
+	// Positions and state changes also go into the breadcrumb trail and trip stats
+	switch name {
+	case "latitude", "longitude", "state", "battery_level", "elevation":
+		queuePositionSample(carID)
+	}
+
+	// Charging values and the battery feed the charging session
+	switch name {
+	case "battery_level", "est_battery_range_km", "charger_power", "charge_energy_added", "time_to_full_charge",
+		"charge_limit_soc", "charger_actual_current", "charger_voltage":
+		sampleCharging(*loc)
+	}
+
+	// Push the change to /events clients
+	queueCarEvent(carID, eventName)
 }
 
-func messagePubHandler(client mqtt.Client, msg mqtt.Message) {
-	// Default handler
+// getCarLocation returns a snapshot of the latest state for the given car
+func getCarLocation(carID int) (Location, bool) {
+	locationMutex.RLock()
+	defer locationMutex.RUnlock()
+
+	loc, ok := cars[carID]
+	if !ok {
+		return Location{CarID: carID}, false
+	}
+	snapshot := *loc
+	if trip, ok := getTrip(carID); ok {
+		snapshot.Trip = &trip
+	}
+	if session, ok := getChargingSession(carID); ok {
+		snapshot.Charging = &session
+	}
+	return snapshot, true
 }
 
-func connectHandler(client mqtt.Client) {
-	log.Println("Connected to MQTT broker")
+// getPublicLocation returns the car's state with privacy zones and the configured
+// units applied, this is what every public endpoint must publish
+func getPublicLocation(carID int) (Location, bool) {
+	loc, ok := getCarLocation(carID)
+	if !ok {
+		return loc, false
+	}
+	cfg := getConfig()
+	return applyUnits(applyPrivacy(loc, cfg.PrivacyZones), unitsFor(cfg.Units)), true
 }
 
-func connectLostHandler(client mqtt.Client, err error) {
-	log.Printf("Connection lost: %v\n", err)
+// requestedCarID resolves the car selected by /cars/{id}/... or ?car=, falling back to the configured default
+func requestedCarID(r *http.Request) (int, error) {
+	idStr := r.PathValue("id")
+	if idStr == "" {
+		idStr = r.URL.Query().Get("car")
+	}
+	if idStr == "" {
+		return getConfig().DefaultCarID, nil
+	}
+	return strconv.Atoi(idStr)
+}
+
+// carQuery returns the ?car= suffix pages should append to their API calls.
+// It is empty when no car was selected explicitly so pages follow the default car.
+func carQuery(r *http.Request) string {
+	idStr := r.PathValue("id")
+	if idStr == "" {
+		idStr = r.URL.Query().Get("car")
+	}
+	if _, err := strconv.Atoi(idStr); err != nil {
+		return ""
+	}
+	return "?car=" + idStr
+}
+
+func messagePubHandler(client mqtt.Client, msg mqtt.Message) {
+	// Default handler
 }
 
 func generateSessionKey() []byte {
@@ -242,21 +564,56 @@ func serveRoot(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Template error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	t.Execute(w, config)
+
+	data := map[string]interface{}{
+		"CarQuery": carQuery(r),
+	}
+	t.Execute(w, data)
 }
 
 func serveLocationJSON(w http.ResponseWriter, r *http.Request) {
-	if config.MapEnabled {
-		locationMutex.RLock()
-		defer locationMutex.RUnlock()
+	if getConfig().MapEnabled {
+		carID, err := requestedCarID(r)
+		if err != nil {
+			http.Error(w, "Invalid car parameter", http.StatusBadRequest)
+			return
+		}
+
+		loc, ok := getPublicLocation(carID)
+		if !ok {
+			http.Error(w, fmt.Sprintf("No data received for car %d", carID), http.StatusNotFound)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(currentLocation)
+		json.NewEncoder(w).Encode(loc)
 	} else {
 		http.Error(w, "Map is disabled in configuration.", http.StatusForbidden)
 	}
 }
 
+func serveCars(w http.ResponseWriter, r *http.Request) {
+	locationMutex.RLock()
+	ids := make([]int, 0, len(cars))
+	for id := range cars {
+		ids = append(ids, id)
+	}
+	summaries := make([]map[string]interface{}, 0, len(ids))
+	sort.Ints(ids)
+	for _, id := range ids {
+		summaries = append(summaries, map[string]interface{}{
+			"car_id":       id,
+			"display_name": cars[id].DisplayName,
+			"state":        cars[id].State,
+			"updated_at":   cars[id].UpdatedAt,
+		})
+	}
+	locationMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
+
 func serveLocalTime(w http.ResponseWriter, r *http.Request) {
 	// Parse latitude and longitude from query parameters
 	latStr := r.URL.Query().Get("lat")
@@ -299,86 +656,164 @@ func serveOverlay(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Template error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	t.Execute(w, nil)
+
+	data := map[string]interface{}{
+		"CarQuery": carQuery(r),
+	}
+	t.Execute(w, data)
 }
 
+// OverlayData is served by /overlay-data. Content is the rendered overlay text;
+// the other fields carry the same information for overlays that do their own layout.
 type OverlayData struct {
-	Content string `json:"content"`
+	Content string          `json:"content"`
+	Version int             `json:"version"` // Bumped when fields change meaning or are removed
+	Status  string          `json:"status"`  // "ok", "waiting" for a car without data, or "disabled"
+	CarID   int             `json:"car_id,omitempty"`
+	Data    *OverlayDetails `json:"data,omitempty"` // Present when Status is "ok"
 }
 
-func serveOverlayData(w http.ResponseWriter, r *http.Request) {
-	var overlayData OverlayData
+// overlayDataVersion is reported as OverlayData.Version
+const overlayDataVersion = 1
+
+// OverlayDetails is the structured form of the overlay, in the configured units
+// with privacy zones applied
+type OverlayDetails struct {
+	LocationName     string              `json:"location_name"`
+	PrivacyZone      string              `json:"privacy_zone,omitempty"`
+	LocalTime        string              `json:"local_time"`
+	Timezone         string              `json:"timezone"`
+	Weather          WeatherData         `json:"weather"`
+	DistanceFromHome *float64            `json:"distance_from_home"` // null until home is set
+	References       []ReferenceDistance `json:"references"`
+	Destination      *OverlayDestination `json:"destination"` // null without an active route
+	Battery          float64             `json:"battery"`
+	Range            float64             `json:"range"`
+	Speed            float64             `json:"speed"`
+	Heading          float64             `json:"heading"`
+	Elevation        float64             `json:"elevation"`
+	State            string              `json:"state"`
+	Trip             *TripStats          `json:"trip,omitempty"`
+	Charging         *ChargingSession    `json:"charging,omitempty"` // While charging and for a while after
+	Units            UnitSystem          `json:"units"`
+	UpdatedAt        time.Time           `json:"updated_at"`
+}
 
-	// Build overlay content if overlay is enabled
-	if config.OverlayEnabled {
-		locationMutex.RLock()
-		loc := currentLocation
-		locationMutex.RUnlock()
-
-		// Get location name (neighborhood/city)
-		locationName := getLocationName(loc.Latitude, loc.Longitude)
-
-		// Get timezone and local time
-		localTime, timezone := getLocalTime(loc.Latitude, loc.Longitude)
-
-		// Get weather data
-		weather := getWeather(loc.Latitude, loc.Longitude)
-
-		// Calculate distance from Baldivis, WA (approximate)
-		distanceFromPerth := calculateDistance(-32.2833, 115.8420, loc.Latitude, loc.Longitude)
-
-		// Build content with optional destination info
-		var content string
-		if loc.Destination != "" {
-			// Convert miles to kilometers for distance to destination
-			kmToDestination := loc.MilesToArrival * 1.60934
-			content = fmt.Sprintf(`📍 Location: %s
-🎯 Destination: %s
-📏 Distance to Destination: %.1f km
-📏 Distance from Home: %.0f km
-
-🕒 Local Time: %s (%s)
-🌡️ Temperature: %.1f°C
-🌤️ Conditions: %s
-💨 Wind: %.1f km/h`,
-				locationName,
-				loc.Destination,
-				kmToDestination,
-				distanceFromPerth,
-				localTime, timezone,
-				weather.Temperature,
-				weather.Description,
-				weather.WindSpeed)
-		} else {
-			content = fmt.Sprintf(`📍 Location: %s
-📏 Distance from Home: %.0f km
-
-🕒 Local Time: %s (%s)
-🌡️ Temperature: %.1f°C
-🌤️ Conditions: %s
-💨 Wind: %.1f km/h`,
-				locationName,
-				distanceFromPerth,
-				localTime, timezone,
-				weather.Temperature,
-				weather.Description,
-				weather.WindSpeed)
+type OverlayDestination struct {
+	Name             string    `json:"name"`
+	Distance         float64   `json:"distance"`
+	MinutesToArrival float64   `json:"minutes_to_arrival"`
+	ETA              time.Time `json:"eta"`
+	EnergyAtArrival  int       `json:"energy_at_arrival"` // Battery % on arrival
+}
+
+func overlayDetails(view OverlayView, cfg Config) *OverlayDetails {
+	details := &OverlayDetails{
+		LocationName: view.LocationName,
+		PrivacyZone:  view.PrivacyZone,
+		LocalTime:    view.LocalTime,
+		Timezone:     view.Timezone,
+		Weather:      view.Weather,
+		References:   view.References,
+		Battery:      view.Battery,
+		Range:        view.Range,
+		Speed:        view.Speed,
+		Heading:      view.Heading,
+		Elevation:    view.Elevation,
+		State:        view.State,
+		Trip:         view.Trip,
+		Charging:     view.Charging,
+		Units:        view.Units,
+		UpdatedAt:    view.UpdatedAt,
+	}
+	if cfg.HomeLatitude != 0 || cfg.HomeLongitude != 0 {
+		lat, lon := view.lookupPosition()
+		distance := view.Units.distance(calculateDistance(cfg.HomeLatitude, cfg.HomeLongitude, lat, lon))
+		details.DistanceFromHome = &distance
+	}
+	if view.Destination != "" {
+		details.Destination = &OverlayDestination{
+			Name:             view.Destination,
+			Distance:         view.DestinationDistance,
+			MinutesToArrival: view.MinutesToArrival,
+			ETA:              time.Now().Add(time.Duration(view.MinutesToArrival * float64(time.Minute))).UTC().Truncate(time.Minute),
+			EnergyAtArrival:  view.EnergyAtArrival,
 		}
+	}
+	return details
+}
+
+// buildOverlayData renders the overlay for a car, shared by /overlay-data and the overlay file writer
+func buildOverlayData(carID int, cfg Config) OverlayData {
+	overlayData := OverlayData{Version: overlayDataVersion}
+
+	// Build overlay content if overlay is enabled
+	if !cfg.OverlayEnabled {
+		overlayData.Status = "disabled"
+		overlayData.Content = "Overlay is disabled in configuration."
+		return overlayData
+	}
 
-		overlayData = OverlayData{Content: content}
+	overlayData.CarID = carID
+	if loc, ok := getPublicLocation(carID); ok {
+		view := buildOverlayView(loc, cfg)
+		overlayData.Status = "ok"
+		overlayData.Content = renderOverlay(currentOverlayTemplate(cfg), view)
+		overlayData.Data = overlayDetails(view, cfg)
 	} else {
-		overlayData = OverlayData{Content: "Overlay is disabled in configuration."}
+		overlayData.Status = "waiting"
+		overlayData.Content = fmt.Sprintf("Waiting for data from car %d...", carID)
+	}
+	return overlayData
+}
+
+func serveOverlayData(w http.ResponseWriter, r *http.Request) {
+	carID, err := requestedCarID(r)
+	if err != nil {
+		http.Error(w, "Invalid car parameter", http.StatusBadRequest)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(overlayData)
+	json.NewEncoder(w).Encode(buildOverlayData(carID, getConfig()))
+}
+
+func publicConfig(cfg Config) PublicConfig {
+	mapboxToken := cfg.MapboxToken
+	if !strings.HasPrefix(mapboxToken, "pk.") {
+		// Secret (sk.) or malformed tokens must not reach the browser
+		mapboxToken = ""
+	}
+
+	return PublicConfig{
+		ShowRoute:      cfg.ShowRoute,
+		MapboxToken:    mapboxToken,
+		MapEnabled:     cfg.MapEnabled,
+		OverlayEnabled: cfg.OverlayEnabled,
+		DefaultCarID:   cfg.DefaultCarID,
+	}
+}
+
+func adminConfig(cfg Config) AdminConfig {
+	view := AdminConfig{
+		Config:                 cfg,
+		TimeZoneDBTokenSet:     cfg.TimeZoneDBToken != "",
+		OpenWeatherMapTokenSet: cfg.OpenWeatherMapToken != "",
+		OBSPasswordSet:         cfg.OBSPassword != "",
+		WebhookSecretSet:       cfg.WebhookSecret != "",
+	}
+	view.TimeZoneDBToken = ""
+	view.OpenWeatherMapToken = ""
+	view.OBSPassword = ""
+	view.WebhookSecret = ""
+	return view
 }
 
 func serveConfig(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(config)
+		json.NewEncoder(w).Encode(publicConfig(getConfig()))
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
@@ -411,6 +846,20 @@ func requireAuth(w http.ResponseWriter, r *http.Request) bool {
 	return true
 }
 
+// hasAdminSession reports whether the request comes from a logged-in admin,
+// for endpoints that answer visitors differently instead of redirecting them
+func hasAdminSession(r *http.Request) bool {
+	session, err := sessionStore.Get(r, "admin-session")
+	if err != nil {
+		return false
+	}
+	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+		return false
+	}
+	loginTime, ok := session.Values["login_time"].(time.Time)
+	return !ok || time.Since(loginTime) <= 24*time.Hour
+}
+
 func serveAdmin(w http.ResponseWriter, r *http.Request) {
 	if !requireAuth(w, r) {
 		return
@@ -442,15 +891,36 @@ func serveAdminConfig(w http.ResponseWriter, r *http.Request) {
 	}
 
 	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(adminConfig(getConfig()))
 	case "POST":
-		var newConfig Config
-		if err := json.NewDecoder(r.Body).Decode(&newConfig); err != nil {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		configUpdateMutex.Lock()
+		defer configUpdateMutex.Unlock()
+
+		// Fields missing from the request, such as the write-only API tokens, keep their values
+		newConfig, err := decodeConfigUpdate(getConfig(), body)
+		if err != nil {
 			http.Error(w, "Invalid JSON", http.StatusBadRequest)
 			return
 		}
-		config = newConfig
+		if err := validateConfig(newConfig); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := updateConfig(newConfig); err != nil {
+			// The new config is live, it just won't survive a restart
+			log.Printf("Failed to save config to %s: %v", configFile, err)
+			http.Error(w, "Configuration applied but could not be saved: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(config)
+		json.NewEncoder(w).Encode(adminConfig(getConfig()))
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
@@ -533,201 +1003,98 @@ func serveAdminLogout(w http.ResponseWriter, r *http.Request) {
 }
 
 func getLocalTime(lat, lon float64) (string, string) {
-	// Using TimeZoneDB API with provided API key
-	apiKey := config.TimeZoneDBToken
-	url := fmt.Sprintf("http://api.timezonedb.com/v2.1/get-time-zone?key=%s&format=json&by=position&lat=%.6f&lng=%.6f", apiKey, lat, lon)
-
-	resp, err := http.Get(url)
+	resolver := currentTimezoneResolver(getConfig())
+	value, err := lookups.get(lookupTimezone, resolver.Name(), lat, lon, "", func(lat, lon float64) (interface{}, error) {
+		return resolver.ResolveTimezone(lat, lon)
+	})
 	if err != nil {
 		log.Printf("Error fetching timezone: %v", err)
 		// Fallback to UTC
 		now := time.Now().UTC()
 		return now.Format("15:04:05"), "UTC"
 	}
-	defer resp.Body.Close()
+	info := value.(TimezoneInfo)
 
-	body, err := io.ReadAll(resp.Body)
+	// Use Go's timezone handling, falling back to the provider's offset
+	loc, err := time.LoadLocation(info.ZoneName)
 	if err != nil {
-		// Fallback to UTC
-		now := time.Now().UTC()
-		return now.Format("15:04:05"), "UTC"
-	}
-
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		// Fallback to UTC
-		now := time.Now().UTC()
-		return now.Format("15:04:05"), "UTC"
-	}
-
-	// Check if the API call was successful
-	if status, ok := result["status"].(string); !ok || status != "OK" {
-		log.Printf("TimeZoneDB API error: %v", result["message"])
-		// Fallback to UTC
-		now := time.Now().UTC()
-		return now.Format("15:04:05"), "UTC"
-	}
-
-	// Extract timezone info from TimeZoneDB response
-	timezoneName := "UTC"
-	if tz, ok := result["zoneName"].(string); ok && tz != "" {
-		timezoneName = tz
-	}
-
-	// Get formatted time directly from the API response if available
-	if formatted, ok := result["formatted"].(string); ok && formatted != "" {
-		// Parse the formatted time from TimeZoneDB (format: "2023-10-25 14:30:15")
-		if parsedTime, err := time.Parse("2006-01-02 15:04:05", formatted); err == nil {
-			// Format timezone display name (remove long path, show just the key part)
-			timezoneDisplay := timezoneName
-			if parts := strings.Split(timezoneName, "/"); len(parts) > 1 {
-				timezoneDisplay = parts[len(parts)-1]
-				// Replace underscores with spaces for readability
-				timezoneDisplay = strings.ReplaceAll(timezoneDisplay, "_", " ")
-			}
-
-			return parsedTime.Format("15:04:05"), timezoneDisplay
-		}
-	}
-
-	// Fallback: use Go's timezone handling
-	loc, err := time.LoadLocation(timezoneName)
-	if err != nil {
-		// If we can't load the timezone, fall back to UTC
-		now := time.Now().UTC()
-		return now.Format("15:04:05"), "UTC"
+		loc = time.FixedZone(info.Abbreviation, info.GMTOffset)
 	}
 
 	now := time.Now().In(loc)
 
 	// Format timezone display name (remove long path, show just the key part)
-	timezoneDisplay := timezoneName
-	if parts := strings.Split(timezoneName, "/"); len(parts) > 1 {
+	timezoneDisplay := info.ZoneName
+	if parts := strings.Split(info.ZoneName, "/"); len(parts) > 1 {
 		timezoneDisplay = parts[len(parts)-1]
 		// Replace underscores with spaces for readability
 		timezoneDisplay = strings.ReplaceAll(timezoneDisplay, "_", " ")
 	}
 
+	// Nautical zones read backwards (Etc/GMT-8 is UTC+8), show the offset instead
+	if strings.HasPrefix(info.ZoneName, "Etc/") {
+		timezoneDisplay = "UTC"
+		if _, offset := now.Zone(); offset != 0 {
+			timezoneDisplay = fmt.Sprintf("UTC%+d", offset/3600)
+		}
+	}
+
 	return now.Format("15:04:05"), timezoneDisplay
 }
 
-func getLocationName(lat, lon float64) string {
-	// Using Nominatim API (OpenStreetMap's free geocoding service)
-	url := fmt.Sprintf("https://nominatim.openstreetmap.org/reverse?format=json&lat=%.6f&lon=%.6f&zoom=14&addressdetails=1", lat, lon)
+// getPlace reverse geocodes a position with the configured Geocoder, falling
+// back to the local GeoNames data when the online service fails or is rate limited
+func getPlace(lat, lon float64) (Place, error) {
+	place, _, err := lookupPlace(lat, lon)
+	return place, err
+}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("Error fetching location name: %v", err)
-		return fmt.Sprintf("%.4f°, %.4f°", lat, lon)
+// lookupPlace is getPlace that also names the provider that answered, which is
+// the offline geocoder when the configured one failed
+func lookupPlace(lat, lon float64) (Place, string, error) {
+	cfg := getConfig()
+	geocoder := currentGeocoder(cfg)
+	provider := geocoder.Name()
+	value, err := lookups.get(lookupLocation, provider, lat, lon, "", func(lat, lon float64) (interface{}, error) {
+		return geocoder.ReverseGeocode(lat, lon)
+	})
+	if err != nil && cfg.GeoNamesFile != "" && provider != providerOffline {
+		log.Printf("Geocoder %s failed, using offline place data: %v", provider, err)
+		offline := offlineGeocoder{placesFile: cfg.GeoNamesFile}
+		provider = offline.Name()
+		value, err = lookups.get(lookupLocation, provider, lat, lon, "", func(lat, lon float64) (interface{}, error) {
+			return offline.ReverseGeocode(lat, lon)
+		})
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Sprintf("%.4f°, %.4f°", lat, lon)
-	}
-
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return fmt.Sprintf("%.4f°, %.4f°", lat, lon)
+		return Place{}, provider, err
 	}
+	return value.(Place), provider, nil
+}
 
-	// Try to extract meaningful location information
-	if address, ok := result["address"].(map[string]interface{}); ok {
-		// Priority order: suburb/neighbourhood -> city -> town -> village -> county -> state
-		locationParts := []string{}
-
-		if suburb, ok := address["suburb"].(string); ok && suburb != "" {
-			locationParts = append(locationParts, suburb)
-		} else if neighbourhood, ok := address["neighbourhood"].(string); ok && neighbourhood != "" {
-			locationParts = append(locationParts, neighbourhood)
-		}
-
-		if city, ok := address["city"].(string); ok && city != "" {
-			locationParts = append(locationParts, city)
-		} else if town, ok := address["town"].(string); ok && town != "" {
-			locationParts = append(locationParts, town)
-		} else if village, ok := address["village"].(string); ok && village != "" {
-			locationParts = append(locationParts, village)
-		}
-
-		if state, ok := address["state"].(string); ok && state != "" {
-			locationParts = append(locationParts, state)
-		}
-
-		if len(locationParts) > 0 {
-			if len(locationParts) == 1 {
-				return locationParts[0]
-			}
-			return fmt.Sprintf("%s, %s", locationParts[0], locationParts[len(locationParts)-1])
-		}
+func getLocationName(lat, lon float64) string {
+	place, err := getPlace(lat, lon)
+	if err != nil {
+		log.Printf("Error fetching location name: %v", err)
 	}
-
-	// Fallback to display_name if available
-	if displayName, ok := result["display_name"].(string); ok && displayName != "" {
-		// Take first part before first comma (usually the most specific location)
-		parts := strings.Split(displayName, ",")
-		if len(parts) > 0 {
-			return strings.TrimSpace(parts[0])
-		}
+	if name := place.FormattedName(); name != "" {
+		return name
 	}
 
 	// Final fallback to coordinates
 	return fmt.Sprintf("%.4f°, %.4f°", lat, lon)
 }
 
-func getWeather(lat, lon float64) WeatherData {
-	// Using Open-Meteo API (free, no API key required)
-	url := fmt.Sprintf("https://api.open-meteo.com/v1/forecast?latitude=%.4f&longitude=%.4f&current=temperature_2m,relative_humidity_2m,weather_code,wind_speed_10m", lat, lon)
-
-	resp, err := http.Get(url)
+func getWeather(lat, lon float64, units UnitSystem) WeatherData {
+	provider := currentWeatherProvider(getConfig())
+	value, err := lookups.get(lookupWeather, provider.Name(), lat, lon, units.Name, func(lat, lon float64) (interface{}, error) {
+		return provider.CurrentWeather(lat, lon, units)
+	})
 	if err != nil {
 		log.Printf("Error fetching weather: %v", err)
-		return WeatherData{Description: "Unavailable"}
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return WeatherData{Description: "Unavailable"}
-	}
-
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return WeatherData{Description: "Unavailable"}
-	}
-
-	current, ok := result["current"].(map[string]interface{})
-	if !ok {
-		return WeatherData{Description: "Unavailable"}
-	}
-
-	temp := 0.0
-	if t, ok := current["temperature_2m"].(float64); ok {
-		temp = t
-	}
-
-	humidity := 0
-	if h, ok := current["relative_humidity_2m"].(float64); ok {
-		humidity = int(h)
-	}
-
-	windSpeed := 0.0
-	if w, ok := current["wind_speed_10m"].(float64); ok {
-		windSpeed = w
-	}
-
-	weatherCode := 0.0
-	if wc, ok := current["weather_code"].(float64); ok {
-		weatherCode = wc
-	}
-
-	return WeatherData{
-		Temperature: temp,
-		Description: weatherCodeToDescription(int(weatherCode)),
-		Humidity:    humidity,
-		WindSpeed:   windSpeed,
+		return WeatherData{Description: "Unavailable", TemperatureUnit: units.Temperature, WindSpeedUnit: units.Speed}
 	}
+	return value.(WeatherData)
 }
 
 func weatherCodeToDescription(code int) string {
@@ -769,38 +1136,11 @@ func calculateDistance(lat1, lon1, lat2, lon2 float64) float64 {
 	// Haversine formula for distance calculation
 	const R = 6371 // Earth's radius in km
 
-	dLat := (lat2 - lat1) * 3.14159265359 / 180
-	dLon := (lon2 - lon1) * 3.14159265359 / 180
-
-	a := 0.5 - 0.5*cosApprox(dLat) + cosApprox(lat1*3.14159265359/180)*cosApprox(lat2*3.14159265359/180)*(1-cosApprox(dLon))/2
-
-	return R * 2 * asinApprox(sqrtApprox(a))
-}
-
-func cosApprox(x float64) float64 {
-	// Simple cosine approximation
-	x = x - float64(int(x/(2*3.14159265359)))*(2*3.14159265359)
-	if x < 0 {
-		x = -x
-	}
-	if x > 3.14159265359 {
-		return -cosApprox(x - 3.14159265359)
-	}
-	x2 := x * x
-	return 1 - x2/2 + x2*x2/24
-}
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
 
-func asinApprox(x float64) float64 {
-	return x + x*x*x/6 + 3*x*x*x*x*x/40
-}
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLon/2)*math.Sin(dLon/2)
 
-func sqrtApprox(x float64) float64 {
-	if x == 0 {
-		return 0
-	}
-	z := x
-	for i := 0; i < 10; i++ {
-		z = (z + x/z) / 2
-	}
-	return z
+	return R * 2 * math.Asin(math.Sqrt(a))
 }
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /metrics serves Prometheus' text exposition format, written by hand to keep
+// the client library out of the build. Counters live here and in mqtt.go, the
+// car gauges are read from the cars map when scraped.
+
+// providerLatencyBuckets are the upper bounds, in seconds, of the provider request histogram
+var providerLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type providerKey struct {
+	Kind, Provider string
+}
+
+type providerMetrics struct {
+	Requests int64
+	Errors   int64
+	Buckets  []int64 // Cumulative counts per providerLatencyBuckets entry
+	Seconds  float64
+
+	// For /readyz
+	LastSuccessAt time.Time
+	LastErrorAt   time.Time
+	LastError     string
+}
+
+type httpRequestKey struct {
+	Handler string
+	Code    int
+}
+
+var (
+	providerRequests = map[providerKey]*providerMetrics{}
+	httpRequests     = map[httpRequestKey]int64{}
+	metricsMutex     sync.Mutex
+)
+
+// recordProviderRequest counts a geocoding, weather or time zone request that
+// reached the provider, cache hits and rate limited lookups are not included
+func recordProviderRequest(kind, provider string, duration time.Duration, err error) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	key := providerKey{kind, provider}
+	stats, ok := providerRequests[key]
+	if !ok {
+		stats = &providerMetrics{Buckets: make([]int64, len(providerLatencyBuckets))}
+		providerRequests[key] = stats
+	}
+	stats.Requests++
+	if err != nil {
+		stats.Errors++
+		stats.LastErrorAt = time.Now()
+		stats.LastError = providerErrorMessage(err)
+	} else {
+		stats.LastSuccessAt = time.Now()
+	}
+	seconds := duration.Seconds()
+	stats.Seconds += seconds
+	for i, bound := range providerLatencyBuckets {
+		if seconds <= bound {
+			stats.Buckets[i]++
+		}
+	}
+}
+
+// providerErrorMessage describes a failed provider request without its URL,
+// which carries the TimeZoneDB or OpenWeatherMap key in the query string
+func providerErrorMessage(err error) string {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err.Error()
+	}
+	host := "provider"
+	if u, parseErr := url.Parse(urlErr.URL); parseErr == nil && u.Host != "" {
+		host = u.Host
+	}
+	return fmt.Sprintf("%s %s: %v", urlErr.Op, host, urlErr.Err)
+}
+
+// getProviderMetrics returns the request counts and last outcome for a provider
+func getProviderMetrics(kind, provider string) (providerMetrics, bool) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	stats, ok := providerRequests[providerKey{kind, provider}]
+	if !ok {
+		return providerMetrics{}, false
+	}
+	return *stats, true
+}
+
+// statusRecorder remembers the response code for countRequests. It keeps
+// Flush so /events can still stream through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// countRequests counts requests per ServeMux pattern and response code
+func countRequests(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(recorder, r)
+
+		// ServeMux fills in the pattern it matched, nothing for a 404
+		handler := r.Pattern
+		if handler == "" {
+			handler = "unmatched"
+		}
+		code := recorder.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+
+		metricsMutex.Lock()
+		httpRequests[httpRequestKey{handler, code}]++
+		metricsMutex.Unlock()
+	})
+}
+
+// metricsWriter writes metric families, one HELP and TYPE header each
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value; labels are name/value pairs
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(m.w, "%s %s\n", b.String(), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := metricsWriter{w}
+
+	writeCarMetrics(m)
+	writeMQTTMetrics(m)
+	writeProviderMetrics(m)
+	writeHTTPMetrics(m)
+}
+
+// writeCarMetrics exports the raw Teslamate values, in Teslamate's units
+func writeCarMetrics(m metricsWriter) {
+	locationMutex.RLock()
+	snapshot := make([]Location, 0, len(cars))
+	for _, loc := range cars {
+		snapshot = append(snapshot, *loc)
+	}
+	locationMutex.RUnlock()
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].CarID < snapshot[j].CarID })
+
+	gauges := []struct {
+		name, help string
+		value      func(Location) float64
+	}{
+		{"tesla_location_car_battery_percent", "Battery level.", func(loc Location) float64 { return loc.Battery }},
+		{"tesla_location_car_range_km", "Estimated range.", func(loc Location) float64 { return loc.Range }},
+		{"tesla_location_car_speed_kmh", "Speed.", func(loc Location) float64 { return loc.Speed }},
+		{"tesla_location_car_elevation_meters", "Elevation.", func(loc Location) float64 { return loc.Elevation }},
+		{"tesla_location_car_charger_power_kw", "Charger power, 0 when not charging.", func(loc Location) float64 { return loc.ChargerPower }},
+		{"tesla_location_car_updated_timestamp_seconds", "When the car last reported its position.", func(loc Location) float64 {
+			if loc.UpdatedAt.IsZero() {
+				return 0
+			}
+			return float64(loc.UpdatedAt.UnixMilli()) / 1000
+		}},
+	}
+	for _, gauge := range gauges {
+		m.family(gauge.name, "gauge", gauge.help)
+		for _, loc := range snapshot {
+			m.sample(gauge.name, gauge.value(loc), "car_id", strconv.Itoa(loc.CarID))
+		}
+	}
+
+	m.family("tesla_location_car_info", "gauge", "Always 1, labelled with the car's name and Teslamate state.")
+	for _, loc := range snapshot {
+		m.sample("tesla_location_car_info", 1, "car_id", strconv.Itoa(loc.CarID), "name", loc.DisplayName, "state", loc.State)
+	}
+}
+
+func writeMQTTMetrics(m metricsWriter) {
+	status := getMQTTStatus()
+	topics := getMQTTTopicCounts()
+
+	m.family("tesla_location_mqtt_connected", "gauge", "1 while connected to the MQTT broker.")
+	m.sample("tesla_location_mqtt_connected", boolValue(status.Connected))
+	m.family("tesla_location_mqtt_reconnects_total", "counter", "Reconnection attempts to the MQTT broker.")
+	m.sample("tesla_location_mqtt_reconnects_total", float64(status.ReconnectCount))
+	m.family("tesla_location_mqtt_last_message_timestamp_seconds", "gauge", "When the last MQTT message arrived, 0 if none has.")
+	lastMessage := 0.0
+	if !status.LastMessageAt.IsZero() {
+		lastMessage = float64(status.LastMessageAt.UnixMilli()) / 1000
+	}
+	m.sample("tesla_location_mqtt_last_message_timestamp_seconds", lastMessage)
+
+	m.family("tesla_location_mqtt_messages_total", "counter", "MQTT messages received per topic.")
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	sort.Strings(names)
+	for _, topic := range names {
+		m.sample("tesla_location_mqtt_messages_total", float64(topics[topic]), "topic", topic)
+	}
+}
+
+func writeProviderMetrics(m metricsWriter) {
+	metricsMutex.Lock()
+	keys := make([]providerKey, 0, len(providerRequests))
+	snapshot := map[providerKey]providerMetrics{}
+	for key, stats := range providerRequests {
+		keys = append(keys, key)
+		copied := *stats
+		copied.Buckets = append([]int64(nil), stats.Buckets...)
+		snapshot[key] = copied
+	}
+	metricsMutex.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Kind != keys[j].Kind {
+			return keys[i].Kind < keys[j].Kind
+		}
+		return keys[i].Provider < keys[j].Provider
+	})
+
+	m.family("tesla_location_provider_requests_total", "counter", "Location, weather and time zone requests made to each provider.")
+	for _, key := range keys {
+		m.sample("tesla_location_provider_requests_total", float64(snapshot[key].Requests), "kind", key.Kind, "provider", key.Provider)
+	}
+	m.family("tesla_location_provider_errors_total", "counter", "Provider requests that failed.")
+	for _, key := range keys {
+		m.sample("tesla_location_provider_errors_total", float64(snapshot[key].Errors), "kind", key.Kind, "provider", key.Provider)
+	}
+
+	name := "tesla_location_provider_request_duration_seconds"
+	m.family(name, "histogram", "How long provider requests took.")
+	for _, key := range keys {
+		stats := snapshot[key]
+		for i, bound := range providerLatencyBuckets {
+			m.sample(name+"_bucket", float64(stats.Buckets[i]), "kind", key.Kind, "provider", key.Provider, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		m.sample(name+"_bucket", float64(stats.Requests), "kind", key.Kind, "provider", key.Provider, "le", "+Inf")
+		m.sample(name+"_sum", stats.Seconds, "kind", key.Kind, "provider", key.Provider)
+		m.sample(name+"_count", float64(stats.Requests), "kind", key.Kind, "provider", key.Provider)
+	}
+
+	cache := lookups.snapshot()
+	kinds := make([]string, 0, len(cache))
+	for kind := range cache {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	m.family("tesla_location_lookup_cache_hits_total", "counter", "Lookups answered from the cache.")
+	for _, kind := range kinds {
+		m.sample("tesla_location_lookup_cache_hits_total", float64(cache[kind].Hits), "kind", kind)
+	}
+	m.family("tesla_location_lookup_cache_misses_total", "counter", "Lookups that needed the provider.")
+	for _, kind := range kinds {
+		m.sample("tesla_location_lookup_cache_misses_total", float64(cache[kind].Misses), "kind", kind)
+	}
+}
+
+func writeHTTPMetrics(m metricsWriter) {
+	metricsMutex.Lock()
+	keys := make([]httpRequestKey, 0, len(httpRequests))
+	counts := map[httpRequestKey]int64{}
+	for key, count := range httpRequests {
+		keys = append(keys, key)
+		counts[key] = count
+	}
+	metricsMutex.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Handler != keys[j].Handler {
+			return keys[i].Handler < keys[j].Handler
+		}
+		return keys[i].Code < keys[j].Code
+	})
+
+	m.family("tesla_location_http_requests_total", "counter", "HTTP requests per handler pattern and response code, counted when they finish.")
+	for _, key := range keys {
+		m.sample("tesla_location_http_requests_total", float64(counts[key]), "handler", key.Handler, "code", strconv.Itoa(key.Code))
+	}
+}
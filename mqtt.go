@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT connection settings, all taken from the environment
+var (
+	mqttScheme      = envOrDefault("MQTT_SCHEME", "tcp")
+	mqttUsername    = os.Getenv("MQTT_USERNAME")
+	mqttPassword    = os.Getenv("MQTT_PASSWORD")
+	mqttCACert      = os.Getenv("MQTT_CA_CERT")
+	mqttClientCert  = os.Getenv("MQTT_CLIENT_CERT")
+	mqttClientKey   = os.Getenv("MQTT_CLIENT_KEY")
+	mqttClientID    = envOrDefault("MQTT_CLIENT_ID", "tesla-location-server")
+	mqttTopicPrefix = topicPrefixFromEnv()
+)
+
+// MQTTStatus records the health of the broker connection for /status
+type MQTTStatus struct {
+	Connected        bool      `json:"connected"`
+	Broker           string    `json:"broker"`
+	LastConnectAt    time.Time `json:"last_connect_at"`
+	LastDisconnectAt time.Time `json:"last_disconnect_at"`
+	LastError        string    `json:"last_error"`
+	ReconnectCount   int       `json:"reconnect_count"`
+	LastMessageAt    time.Time `json:"last_message_at"`
+	MessageCount     int64     `json:"message_count"`
+}
+
+var (
+	mqttStatus      MQTTStatus
+	mqttTopicCounts = map[string]int64{} // Messages per topic, for /metrics
+	mqttStatusMutex sync.RWMutex
+)
+
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// topicPrefixFromEnv returns the topic root Teslamate publishes under.
+// MQTT_TOPIC_PREFIX wins; otherwise MQTT_NAMESPACE mirrors Teslamate's own setting (teslamate/<ns>).
+func topicPrefixFromEnv() string {
+	if prefix := os.Getenv("MQTT_TOPIC_PREFIX"); prefix != "" {
+		return strings.Trim(prefix, "/")
+	}
+	if namespace := os.Getenv("MQTT_NAMESPACE"); namespace != "" {
+		return "teslamate/" + strings.Trim(namespace, "/")
+	}
+	return "teslamate"
+}
+
+// brokerURL combines MQTT_SCHEME and MQTT_BROKER, unless MQTT_BROKER already carries a scheme
+func brokerURL() (string, error) {
+	if strings.Contains(mqttBroker, "://") {
+		return mqttBroker, nil
+	}
+
+	switch mqttScheme {
+	case "tcp", "ssl", "ws", "wss":
+		return mqttScheme + "://" + mqttBroker, nil
+	default:
+		return "", fmt.Errorf("unsupported MQTT_SCHEME %q (expected tcp, ssl, ws or wss)", mqttScheme)
+	}
+}
+
+func newMQTTClientOptions() (*mqtt.ClientOptions, error) {
+	broker, err := brokerURL()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(mqttClientID)
+	opts.SetUsername(mqttUsername)
+	opts.SetPassword(mqttPassword)
+
+	// Keep retrying the initial connection and reconnect with exponential backoff
+	// (1s doubling up to the max interval). Subscriptions are restored in connectHandler.
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetMaxReconnectInterval(2 * time.Minute)
+	opts.SetCleanSession(true)
+
+	mqttStatusMutex.Lock()
+	mqttStatus.Broker = broker
+	mqttStatusMutex.Unlock()
+
+	if mqttCACert != "" || mqttClientCert != "" {
+		tlsConfig, err := newMQTTTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	return opts, nil
+}
+
+func newMQTTTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if mqttCACert != "" {
+		pem, err := os.ReadFile(mqttCACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading MQTT CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", mqttCACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if mqttClientCert != "" {
+		if mqttClientKey == "" {
+			return nil, fmt.Errorf("MQTT_CLIENT_CERT requires MQTT_CLIENT_KEY")
+		}
+		cert, err := tls.LoadX509KeyPair(mqttClientCert, mqttClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading MQTT client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func connectHandler(client mqtt.Client) {
+	log.Println("Connected to MQTT broker")
+
+	mqttStatusMutex.Lock()
+	mqttStatus.Connected = true
+	mqttStatus.LastConnectAt = time.Now()
+	mqttStatus.LastError = ""
+	mqttStatusMutex.Unlock()
+
+	// Clean sessions drop subscriptions on the broker side, so subscribe on every (re)connect
+	subscribeToTopics(client)
+}
+
+func connectLostHandler(client mqtt.Client, err error) {
+	log.Printf("Connection lost: %v\n", err)
+
+	mqttStatusMutex.Lock()
+	mqttStatus.Connected = false
+	mqttStatus.LastDisconnectAt = time.Now()
+	mqttStatus.LastError = err.Error()
+	mqttStatusMutex.Unlock()
+}
+
+// connectionNotificationHandler records why a connection attempt failed. Paho
+// retries the first connection and reconnects in the background, so without
+// this a wrong password or TLS error would only show as "not connected".
+func connectionNotificationHandler(client mqtt.Client, notification mqtt.ConnectionNotification) {
+	failed, ok := notification.(mqtt.ConnectionNotificationFailed)
+	if !ok || failed.Reason == nil {
+		return
+	}
+
+	mqttStatusMutex.Lock()
+	changed := mqttStatus.LastError != failed.Reason.Error()
+	mqttStatus.Connected = false
+	mqttStatus.LastError = failed.Reason.Error()
+	mqttStatusMutex.Unlock()
+
+	// Attempts repeat every few seconds, only log a new reason
+	if changed {
+		log.Printf("Can't connect to MQTT broker, retrying: %v\n", failed.Reason)
+	}
+}
+
+func reconnectingHandler(client mqtt.Client, opts *mqtt.ClientOptions) {
+	mqttStatusMutex.Lock()
+	mqttStatus.ReconnectCount++
+	count := mqttStatus.ReconnectCount
+	mqttStatusMutex.Unlock()
+
+	log.Printf("Reconnecting to MQTT broker (attempt %d)\n", count)
+}
+
+func recordMQTTMessage(topic string) {
+	mqttStatusMutex.Lock()
+	mqttStatus.LastMessageAt = time.Now()
+	mqttStatus.MessageCount++
+	mqttTopicCounts[topic]++
+	mqttStatusMutex.Unlock()
+}
+
+func getMQTTTopicCounts() map[string]int64 {
+	mqttStatusMutex.RLock()
+	defer mqttStatusMutex.RUnlock()
+	counts := make(map[string]int64, len(mqttTopicCounts))
+	for topic, count := range mqttTopicCounts {
+		counts[topic] = count
+	}
+	return counts
+}
+
+func getMQTTStatus() MQTTStatus {
+	mqttStatusMutex.RLock()
+	defer mqttStatusMutex.RUnlock()
+	return mqttStatus
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	status := getMQTTStatus()
+
+	response := map[string]interface{}{
+		"mqtt":                  status,
+		"seconds_since_message": secondsSince(status.LastMessageAt),
+		"seconds_since_connect": secondsSince(status.LastConnectAt),
+		"server_time":           time.Now(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// secondsSince returns the age of t in seconds, or -1 if t was never set
+func secondsSince(t time.Time) float64 {
+	if t.IsZero() {
+		return -1
+	}
+	return time.Since(t).Seconds()
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// OBSRule changes OBS when the car's state changes or it enters or leaves a
+// privacy zone, e.g. "on state=charging switch to scene Charging"
+type OBSRule struct {
+	CarID  int    `json:"car_id"` // 0 for the default car
+	On     string `json:"on"`     // "state", "zone_enter" or "zone_exit"
+	Value  string `json:"value"`  // The Teslamate state, or the zone name (empty for any zone)
+	Action string `json:"action"` // "switch_scene", "hide_source" or "show_source"
+	Scene  string `json:"scene"`  // Scene to switch to, or the scene holding the source (empty for the current one)
+	Source string `json:"source"` // Source to hide or show
+}
+
+const (
+	obsOnState     = "state"
+	obsOnZoneEnter = "zone_enter"
+	obsOnZoneExit  = "zone_exit"
+
+	obsSwitchScene = "switch_scene"
+	obsHideSource  = "hide_source"
+	obsShowSource  = "show_source"
+)
+
+func (r OBSRule) validate() error {
+	switch r.On {
+	case obsOnState:
+		if r.Value == "" {
+			return errors.New("OBS rule: a state rule needs the state, e.g. charging")
+		}
+	case obsOnZoneEnter, obsOnZoneExit:
+	default:
+		return fmt.Errorf("OBS rule: unknown trigger %q, use state, zone_enter or zone_exit", r.On)
+	}
+	switch r.Action {
+	case obsSwitchScene:
+		if r.Scene == "" {
+			return errors.New("OBS rule: switching scene needs a scene name")
+		}
+	case obsHideSource, obsShowSource:
+		if r.Source == "" {
+			return errors.New("OBS rule: hiding or showing a source needs a source name")
+		}
+	default:
+		return fmt.Errorf("OBS rule: unknown action %q, use switch_scene, hide_source or show_source", r.Action)
+	}
+	return nil
+}
+
+// String describes the rule for the log, e.g. "on state=charging switch to scene Charging"
+func (r OBSRule) String() string {
+	trigger := "on " + r.On
+	if r.Value != "" {
+		trigger += "=" + r.Value
+	}
+	scene := r.Scene
+	if scene == "" {
+		scene = "the current scene"
+	}
+	switch r.Action {
+	case obsSwitchScene:
+		return fmt.Sprintf("%s switch to scene %s", trigger, r.Scene)
+	case obsHideSource:
+		return fmt.Sprintf("%s hide source %s in %s", trigger, r.Source, scene)
+	default:
+		return fmt.Sprintf("%s show source %s in %s", trigger, r.Source, scene)
+	}
+}
+
+// obsCarState is what rules compare between successive samples of a car
+type obsCarState struct {
+	State       string
+	HasPosition bool
+	InZone      bool
+	Zone        string
+}
+
+func (r OBSRule) matches(previous, current obsCarState) bool {
+	switch r.On {
+	case obsOnState:
+		// A car seen for the first time hasn't changed state, so a restart doesn't switch scenes
+		return previous.State != "" && current.State != previous.State && strings.EqualFold(current.State, r.Value)
+	case obsOnZoneEnter:
+		entered := current.InZone && (!previous.InZone || previous.Zone != current.Zone)
+		return previous.HasPosition && entered && (r.Value == "" || r.Value == current.Zone)
+	case obsOnZoneExit:
+		left := previous.InZone && (!current.InZone || previous.Zone != current.Zone)
+		return previous.HasPosition && left && (r.Value == "" || r.Value == previous.Zone)
+	}
+	return false
+}
+
+const obsRuleQueueSize = 32
+
+var (
+	obsCarStates = map[int]obsCarState{}
+	obsMutex     sync.Mutex
+
+	// Triggered rules, run one batch at a time by runOBSConnection
+	obsRuleQueue = make(chan []OBSRule, obsRuleQueueSize)
+)
+
+// evaluateOBSRules runs the rules triggered by what changed since the car's previous sample
+func evaluateOBSRules(loc Location) {
+	cfg := getConfig()
+	zone, inZone := findPrivacyZone(loc.Latitude, loc.Longitude, cfg.PrivacyZones)
+	current := obsCarState{
+		State:       loc.State,
+		HasPosition: loc.Latitude != 0 || loc.Longitude != 0,
+		InZone:      inZone,
+		Zone:        zone.Name,
+	}
+
+	// Held until the rules are queued, so they reach OBS in the order the samples were evaluated
+	obsMutex.Lock()
+	defer obsMutex.Unlock()
+	previous := obsCarStates[loc.CarID]
+	obsCarStates[loc.CarID] = current
+
+	var triggered []OBSRule
+	for _, rule := range cfg.OBSRules {
+		carID := rule.CarID
+		if carID == 0 {
+			carID = cfg.DefaultCarID
+		}
+		if carID == loc.CarID && rule.matches(previous, current) {
+			triggered = append(triggered, rule)
+		}
+	}
+	if len(triggered) > 0 && cfg.OBSURL != "" {
+		select {
+		case obsRuleQueue <- triggered:
+		default:
+			for _, rule := range triggered {
+				logOBSRule(rule, errors.New("too many rules waiting for OBS"))
+			}
+		}
+	}
+}
+
+// OBSLogEntry records a rule run for the admin page
+type OBSLogEntry struct {
+	Time  time.Time `json:"time"`
+	Rule  string    `json:"rule"`
+	Error string    `json:"error,omitempty"`
+}
+
+const obsLogSize = 20
+
+var (
+	obsLog      []OBSLogEntry // Newest first
+	obsLogMutex sync.Mutex
+)
+
+func logOBSRule(rule OBSRule, err error) {
+	entry := OBSLogEntry{Time: time.Now(), Rule: rule.String()}
+	if err != nil {
+		entry.Error = err.Error()
+		log.Printf("OBS rule %q failed: %v", entry.Rule, err)
+	} else {
+		log.Printf("OBS rule %q applied", entry.Rule)
+	}
+
+	obsLogMutex.Lock()
+	defer obsLogMutex.Unlock()
+	obsLog = append([]OBSLogEntry{entry}, obsLog...)
+	if len(obsLog) > obsLogSize {
+		obsLog = obsLog[:obsLogSize]
+	}
+}
+
+// runOBSRules applies rules in order, so a scene switch lands before a source
+// in the new scene is hidden
+func runOBSRules(rules []OBSRule) {
+	client := currentOBSClient()
+	for _, rule := range rules {
+		err := errors.New("not connected to OBS")
+		if client != nil {
+			err = applyOBSRule(client, rule)
+		}
+		logOBSRule(rule, err)
+	}
+}
+
+func applyOBSRule(client *obsClient, rule OBSRule) error {
+	if rule.Action == obsSwitchScene {
+		_, err := client.request("SetCurrentProgramScene", map[string]interface{}{"sceneName": rule.Scene})
+		return err
+	}
+
+	scene := rule.Scene
+	if scene == "" {
+		var current struct {
+			Name string `json:"currentProgramSceneName"`
+		}
+		if err := client.requestInto("GetCurrentProgramScene", nil, &current); err != nil {
+			return err
+		}
+		scene = current.Name
+	}
+
+	var item struct {
+		ID int `json:"sceneItemId"`
+	}
+	if err := client.requestInto("GetSceneItemId", map[string]interface{}{"sceneName": scene, "sourceName": rule.Source}, &item); err != nil {
+		return err
+	}
+	_, err := client.request("SetSceneItemEnabled", map[string]interface{}{
+		"sceneName":        scene,
+		"sceneItemId":      item.ID,
+		"sceneItemEnabled": rule.Action == obsShowSource,
+	})
+	return err
+}
+
+// OBS WebSocket v5 opcodes, see
+// https://github.com/obsproject/obs-websocket/blob/master/docs/generated/protocol.md
+const (
+	obsOpHello           = 0
+	obsOpIdentify        = 1
+	obsOpIdentified      = 2
+	obsOpRequest         = 6
+	obsOpRequestResponse = 7
+
+	obsRPCVersion     = 1
+	obsSubprotocol    = "obswebsocket.json"
+	obsRequestTimeout = 5 * time.Second
+
+	// Reconnect backoff after OBS is closed or unreachable
+	obsMinRetry = 2 * time.Second
+	obsMaxRetry = time.Minute
+)
+
+type obsMessage struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+}
+
+type obsResponse struct {
+	RequestType   string `json:"requestType"`
+	RequestID     string `json:"requestId"`
+	RequestStatus struct {
+		Result  bool   `json:"result"`
+		Code    int    `json:"code"`
+		Comment string `json:"comment"`
+	} `json:"requestStatus"`
+	ResponseData json.RawMessage `json:"responseData"`
+}
+
+// obsClient is a connection to obs-websocket. Requests may be made from any
+// goroutine, responses are matched up by readLoop.
+type obsClient struct {
+	conn     *websocket.Conn
+	address  string
+	password string
+
+	writeMutex sync.Mutex
+
+	pendingMutex sync.Mutex
+	pending      map[string]chan obsResponse
+	nextID       int
+
+	done chan struct{} // Closed when the connection is gone
+	err  error         // Why, set before done is closed
+}
+
+// obsAuthentication answers the Hello challenge:
+// base64(sha256(base64(sha256(password + salt)) + challenge))
+func obsAuthentication(password, salt, challenge string) string {
+	secret := sha256.Sum256([]byte(password + salt))
+	auth := sha256.Sum256([]byte(base64.StdEncoding.EncodeToString(secret[:]) + challenge))
+	return base64.StdEncoding.EncodeToString(auth[:])
+}
+
+// readOBSMessage reads the next message, which must have the given opcode, into v
+func readOBSMessage(conn *websocket.Conn, op int, v interface{}) error {
+	var msg obsMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		return err
+	}
+	if msg.Op != op {
+		return fmt.Errorf("expected opcode %d, got %d", op, msg.Op)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(msg.D, v)
+}
+
+func writeOBSMessage(conn *websocket.Conn, op int, d interface{}) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return conn.WriteJSON(obsMessage{Op: op, D: data})
+}
+
+// dialOBS connects and identifies, address is e.g. ws://localhost:4455
+func dialOBS(address, password string) (*obsClient, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: obsRequestTimeout, Subprotocols: []string{obsSubprotocol}}
+	conn, _, err := dialer.Dial(address, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(obsRequestTimeout))
+	var hello struct {
+		Version        string `json:"obsWebSocketVersion"`
+		Authentication *struct {
+			Challenge string `json:"challenge"`
+			Salt      string `json:"salt"`
+		} `json:"authentication"`
+	}
+	if err := readOBSMessage(conn, obsOpHello, &hello); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("waiting for Hello: %w", err)
+	}
+
+	identify := map[string]interface{}{
+		"rpcVersion":         obsRPCVersion,
+		"eventSubscriptions": 0, // Rules only make requests
+	}
+	if hello.Authentication != nil {
+		if password == "" {
+			conn.Close()
+			return nil, errors.New("OBS requires a password")
+		}
+		identify["authentication"] = obsAuthentication(password, hello.Authentication.Salt, hello.Authentication.Challenge)
+	}
+	if err := writeOBSMessage(conn, obsOpIdentify, identify); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// A wrong password closes the connection with code 4009
+	if err := readOBSMessage(conn, obsOpIdentified, nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("identifying: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	log.Printf("Connected to OBS WebSocket %s at %s", hello.Version, address)
+
+	client := &obsClient{
+		conn:     conn,
+		address:  address,
+		password: password,
+		pending:  map[string]chan obsResponse{},
+		done:     make(chan struct{}),
+	}
+	go client.readLoop()
+	return client, nil
+}
+
+func (c *obsClient) readLoop() {
+	var err error
+	for {
+		var msg obsMessage
+		if err = c.conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		// Events aren't subscribed to, anything but responses is ignored
+		if msg.Op != obsOpRequestResponse {
+			continue
+		}
+		var response obsResponse
+		if json.Unmarshal(msg.D, &response) != nil {
+			continue
+		}
+		c.pendingMutex.Lock()
+		ch, ok := c.pending[response.RequestID]
+		delete(c.pending, response.RequestID)
+		c.pendingMutex.Unlock()
+		if ok {
+			ch <- response
+		}
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+func (c *obsClient) close() {
+	c.conn.Close()
+	<-c.done
+}
+
+// request sends an OBS request and waits for its response data
+func (c *obsClient) request(requestType string, data interface{}) (json.RawMessage, error) {
+	c.pendingMutex.Lock()
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	ch := make(chan obsResponse, 1)
+	c.pending[id] = ch
+	c.pendingMutex.Unlock()
+	defer func() {
+		c.pendingMutex.Lock()
+		delete(c.pending, id)
+		c.pendingMutex.Unlock()
+	}()
+
+	request := map[string]interface{}{"requestType": requestType, "requestId": id}
+	if data != nil {
+		request["requestData"] = data
+	}
+	c.writeMutex.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(obsRequestTimeout))
+	err := writeOBSMessage(c.conn, obsOpRequest, request)
+	c.writeMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-ch:
+		if !response.RequestStatus.Result {
+			return nil, fmt.Errorf("%s: %s (code %d)", requestType, response.RequestStatus.Comment, response.RequestStatus.Code)
+		}
+		return response.ResponseData, nil
+	case <-c.done:
+		return nil, fmt.Errorf("%s: connection closed: %v", requestType, c.err)
+	case <-time.After(obsRequestTimeout):
+		return nil, fmt.Errorf("%s: no response from OBS", requestType)
+	}
+}
+
+// requestInto is request with the response data decoded into v
+func (c *obsClient) requestInto(requestType string, data, v interface{}) error {
+	response, err := c.request(requestType, data)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(response, v); err != nil {
+		return fmt.Errorf("%s: %w", requestType, err)
+	}
+	return nil
+}
+
+var obsConnection struct {
+	sync.Mutex
+	client *obsClient
+	err    string // Last connection error, shown on the admin page
+}
+
+func currentOBSClient() *obsClient {
+	obsConnection.Lock()
+	defer obsConnection.Unlock()
+	return obsConnection.client
+}
+
+func setOBSConnection(client *obsClient, err error) {
+	obsConnection.Lock()
+	defer obsConnection.Unlock()
+	obsConnection.client = client
+	obsConnection.err = ""
+	if err != nil {
+		obsConnection.err = err.Error()
+	}
+}
+
+// runOBSConnection keeps a connection to OBS while Config.OBSURL is set,
+// reconnecting with backoff and whenever the address or password changes. It
+// also runs queued rules, one batch at a time so they apply in order.
+func runOBSConnection() {
+	updates := events.subscribe()
+	defer events.unsubscribe(updates)
+
+	var client *obsClient
+	retry := obsMinRetry
+	for {
+		cfg := getConfig()
+		if client != nil && (client.address != cfg.OBSURL || client.password != cfg.OBSPassword) {
+			client.close()
+			client = nil
+			setOBSConnection(nil, nil)
+		}
+		if client != nil {
+			select {
+			case <-client.done:
+				log.Printf("Lost connection to OBS: %v", client.err)
+				setOBSConnection(nil, client.err)
+				client = nil
+			default:
+			}
+		}
+
+		var wait <-chan time.Time
+		if client == nil && cfg.OBSURL != "" {
+			var err error
+			if client, err = dialOBS(cfg.OBSURL, cfg.OBSPassword); err != nil {
+				if retry == obsMinRetry {
+					log.Printf("Can't connect to OBS at %s, retrying: %v", cfg.OBSURL, err)
+				}
+				setOBSConnection(nil, err)
+				wait = time.After(retry)
+				retry = min(retry*2, obsMaxRetry)
+			} else {
+				setOBSConnection(client, nil)
+				retry = obsMinRetry
+			}
+		}
+
+		var closed <-chan struct{}
+		if client != nil {
+			closed = client.done
+		}
+		// Car events are frequent, only config changes cut a retry wait short
+		for waiting := true; waiting; {
+			select {
+			case event := <-updates:
+				waiting = event.Name != "config"
+			case <-closed:
+				waiting = false
+			case <-wait:
+				waiting = false
+			case rules := <-obsRuleQueue:
+				runOBSRules(rules)
+			}
+		}
+	}
+}
+
+// OBSStatus is served by /admin/obs
+type OBSStatus struct {
+	Configured   bool          `json:"configured"`
+	Connected    bool          `json:"connected"`
+	Error        string        `json:"error,omitempty"`
+	CurrentScene string        `json:"current_scene,omitempty"`
+	Scenes       []string      `json:"scenes"`
+	Log          []OBSLogEntry `json:"log"`
+}
+
+func getOBSStatus() OBSStatus {
+	status := OBSStatus{Configured: getConfig().OBSURL != "", Scenes: []string{}}
+
+	obsConnection.Lock()
+	client := obsConnection.client
+	status.Error = obsConnection.err
+	obsConnection.Unlock()
+
+	if client != nil {
+		var scenes struct {
+			Current string `json:"currentProgramSceneName"`
+			Scenes  []struct {
+				Name string `json:"sceneName"`
+			} `json:"scenes"`
+		}
+		if err := client.requestInto("GetSceneList", nil, &scenes); err != nil {
+			status.Error = err.Error()
+		} else {
+			status.Connected = true
+			status.CurrentScene = scenes.Current
+			// OBS lists scenes bottom up
+			for i := len(scenes.Scenes) - 1; i >= 0; i-- {
+				status.Scenes = append(status.Scenes, scenes.Scenes[i].Name)
+			}
+		}
+	}
+
+	obsLogMutex.Lock()
+	status.Log = append([]OBSLogEntry{}, obsLog...)
+	obsLogMutex.Unlock()
+	return status
+}
+
+// serveAdminOBS reports the OBS connection (GET) or runs a rule straight away
+// to try it out (POST {"rule": {...}})
+func serveAdminOBS(w http.ResponseWriter, r *http.Request) {
+	if !requireAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var request struct {
+			Rule OBSRule `json:"rule"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := request.Rule.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		runOBSRules([]OBSRule{request.Rule})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getOBSStatus())
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeOBS speaks enough of the obs-websocket v5 protocol to try out OBS rules
+// without OBS: scenes and their sources are kept in memory and every change is
+// logged. Run it with "tesla-location-server fake-obs".
+type fakeOBS struct {
+	password string
+
+	mutex        sync.Mutex
+	scenes       []string                 // In the order given
+	items        map[string][]fakeOBSItem // Scene items by scene name
+	currentScene string
+}
+
+type fakeOBSItem struct {
+	ID      int
+	Source  string
+	Enabled bool
+}
+
+// OBS request status codes used by the fake
+const (
+	fakeOBSSuccess             = 100
+	fakeOBSMissingField        = 300
+	fakeOBSResourceNotFound    = 600
+	fakeOBSUnknownRequest      = 204
+	fakeOBSAuthFailedCloseCode = 4009
+)
+
+func newFakeOBS(scenes, sources []string, password string) *fakeOBS {
+	f := &fakeOBS{password: password, scenes: scenes, items: map[string][]fakeOBSItem{}}
+	for _, scene := range scenes {
+		for i, source := range sources {
+			f.items[scene] = append(f.items[scene], fakeOBSItem{ID: i + 1, Source: source, Enabled: true})
+		}
+	}
+	if len(scenes) > 0 {
+		f.currentScene = scenes[0]
+	}
+	return f
+}
+
+var fakeOBSUpgrader = websocket.Upgrader{
+	Subprotocols: []string{obsSubprotocol},
+	CheckOrigin:  func(r *http.Request) bool { return true },
+}
+
+func (f *fakeOBS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := fakeOBSUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	hello := map[string]interface{}{"obsWebSocketVersion": "5.0.0-fake", "rpcVersion": obsRPCVersion}
+	var salt, challenge string
+	if f.password != "" {
+		salt, challenge = randomToken(), randomToken()
+		hello["authentication"] = map[string]string{"challenge": challenge, "salt": salt}
+	}
+	if err := writeOBSMessage(conn, obsOpHello, hello); err != nil {
+		return
+	}
+
+	var identify struct {
+		Authentication string `json:"authentication"`
+	}
+	if err := readOBSMessage(conn, obsOpIdentify, &identify); err != nil {
+		log.Printf("Fake OBS: bad Identify from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	if f.password != "" && identify.Authentication != obsAuthentication(f.password, salt, challenge) {
+		log.Printf("Fake OBS: wrong password from %s", r.RemoteAddr)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(fakeOBSAuthFailedCloseCode, "Authentication failed."))
+		return
+	}
+	if err := writeOBSMessage(conn, obsOpIdentified, map[string]int{"negotiatedRpcVersion": obsRPCVersion}); err != nil {
+		return
+	}
+	log.Printf("Fake OBS: client %s identified", r.RemoteAddr)
+
+	for {
+		var request struct {
+			RequestType string                 `json:"requestType"`
+			RequestID   string                 `json:"requestId"`
+			RequestData map[string]interface{} `json:"requestData"`
+		}
+		if err := readOBSMessage(conn, obsOpRequest, &request); err != nil {
+			log.Printf("Fake OBS: client %s gone: %v", r.RemoteAddr, err)
+			return
+		}
+
+		data, code, comment := f.handle(request.RequestType, request.RequestData)
+		status := map[string]interface{}{"result": code == fakeOBSSuccess, "code": code}
+		if comment != "" {
+			status["comment"] = comment
+		}
+		response := map[string]interface{}{
+			"requestType":   request.RequestType,
+			"requestId":     request.RequestID,
+			"requestStatus": status,
+		}
+		if data != nil {
+			response["responseData"] = data
+		}
+		if err := writeOBSMessage(conn, obsOpRequestResponse, response); err != nil {
+			return
+		}
+	}
+}
+
+// handle runs one request, returning the response data and status
+func (f *fakeOBS) handle(requestType string, data map[string]interface{}) (interface{}, int, string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	sceneName, _ := data["sceneName"].(string)
+	switch requestType {
+	case "GetVersion":
+		return map[string]interface{}{"obsWebSocketVersion": "5.0.0-fake", "rpcVersion": obsRPCVersion}, fakeOBSSuccess, ""
+
+	case "GetSceneList":
+		// Bottom up, like OBS
+		scenes := []map[string]interface{}{}
+		for i := len(f.scenes) - 1; i >= 0; i-- {
+			scenes = append(scenes, map[string]interface{}{"sceneName": f.scenes[i], "sceneIndex": len(f.scenes) - 1 - i})
+		}
+		return map[string]interface{}{"currentProgramSceneName": f.currentScene, "scenes": scenes}, fakeOBSSuccess, ""
+
+	case "GetCurrentProgramScene":
+		return map[string]interface{}{"currentProgramSceneName": f.currentScene, "sceneName": f.currentScene}, fakeOBSSuccess, ""
+
+	case "SetCurrentProgramScene":
+		if _, ok := f.items[sceneName]; !ok {
+			return nil, fakeOBSResourceNotFound, fmt.Sprintf("No source was found by the name of `%s`.", sceneName)
+		}
+		f.currentScene = sceneName
+		log.Printf("Fake OBS: program scene is now %s", sceneName)
+		return nil, fakeOBSSuccess, ""
+
+	case "GetSceneItemId":
+		sourceName, _ := data["sourceName"].(string)
+		items, ok := f.items[sceneName]
+		if !ok {
+			return nil, fakeOBSResourceNotFound, fmt.Sprintf("No source was found by the name of `%s`.", sceneName)
+		}
+		for _, item := range items {
+			if item.Source == sourceName {
+				return map[string]int{"sceneItemId": item.ID}, fakeOBSSuccess, ""
+			}
+		}
+		return nil, fakeOBSResourceNotFound, "No scene items were found in the specified scene by that name or offset."
+
+	case "SetSceneItemEnabled":
+		id, ok := data["sceneItemId"].(float64)
+		enabled, hasEnabled := data["sceneItemEnabled"].(bool)
+		if !ok || !hasEnabled {
+			return nil, fakeOBSMissingField, "Your request is missing sceneItemId or sceneItemEnabled."
+		}
+		items := f.items[sceneName]
+		for i := range items {
+			if items[i].ID == int(id) {
+				items[i].Enabled = enabled
+				state := "hidden"
+				if enabled {
+					state = "shown"
+				}
+				log.Printf("Fake OBS: %s in %s %s", items[i].Source, sceneName, state)
+				return nil, fakeOBSSuccess, ""
+			}
+		}
+		return nil, fakeOBSResourceNotFound, "No scene items were found in the specified scene by that name or offset."
+
+	case "GetSceneItemList":
+		items, ok := f.items[sceneName]
+		if !ok {
+			return nil, fakeOBSResourceNotFound, fmt.Sprintf("No source was found by the name of `%s`.", sceneName)
+		}
+		list := []map[string]interface{}{}
+		for _, item := range items {
+			list = append(list, map[string]interface{}{"sceneItemId": item.ID, "sourceName": item.Source, "sceneItemEnabled": item.Enabled})
+		}
+		return map[string]interface{}{"sceneItems": list}, fakeOBSSuccess, ""
+	}
+	return nil, fakeOBSUnknownRequest, "Your request type is not valid."
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// runFakeOBSCommand implements "tesla-location-server fake-obs"
+func runFakeOBSCommand(args []string) int {
+	flags := flag.NewFlagSet("fake-obs", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:4455", "address to listen on")
+	password := flags.String("password", "", "require this password, like OBS with authentication enabled")
+	scenes := flags.String("scenes", "Driving,Parked,Charging", "comma-separated scene names, the first is the program scene")
+	sources := flags.String("sources", "Map,Camera,Overlay", "comma-separated sources added to every scene")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: tesla-location-server fake-obs [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	f := newFakeOBS(splitList(*scenes), splitList(*sources), *password)
+	log.Printf("Fake OBS listening on ws://%s with scenes %s", *addr, strings.Join(f.scenes, ", "))
+	if err := http.ListenAndServe(*addr, f); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// splitList splits a comma-separated flag, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
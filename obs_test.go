@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOBSRuleMatches(t *testing.T) {
+	parked := obsCarState{State: "online", HasPosition: true}
+	home := obsCarState{State: "online", HasPosition: true, InZone: true, Zone: "Home"}
+	work := obsCarState{State: "online", HasPosition: true, InZone: true, Zone: "Work"}
+
+	tests := []struct {
+		name              string
+		rule              OBSRule
+		previous, current obsCarState
+		want              bool
+	}{
+		{"state changed", OBSRule{On: obsOnState, Value: "charging"}, parked, obsCarState{State: "charging"}, true},
+		{"state is case insensitive", OBSRule{On: obsOnState, Value: "Charging"}, parked, obsCarState{State: "charging"}, true},
+		{"state unchanged", OBSRule{On: obsOnState, Value: "charging"}, obsCarState{State: "charging"}, obsCarState{State: "charging"}, false},
+		{"other state", OBSRule{On: obsOnState, Value: "charging"}, parked, obsCarState{State: "driving"}, false},
+		{"first sample after startup", OBSRule{On: obsOnState, Value: "charging"}, obsCarState{}, obsCarState{State: "charging"}, false},
+
+		{"enter any zone", OBSRule{On: obsOnZoneEnter}, parked, home, true},
+		{"enter named zone", OBSRule{On: obsOnZoneEnter, Value: "Home"}, parked, home, true},
+		{"enter other zone", OBSRule{On: obsOnZoneEnter, Value: "Work"}, parked, home, false},
+		{"move between zones", OBSRule{On: obsOnZoneEnter, Value: "Work"}, home, work, true},
+		{"stay in zone", OBSRule{On: obsOnZoneEnter}, home, home, false},
+		{"enter without a previous position", OBSRule{On: obsOnZoneEnter}, obsCarState{}, home, false},
+
+		{"exit any zone", OBSRule{On: obsOnZoneExit}, home, parked, true},
+		{"exit named zone", OBSRule{On: obsOnZoneExit, Value: "Home"}, home, parked, true},
+		{"exit other zone", OBSRule{On: obsOnZoneExit, Value: "Work"}, home, parked, false},
+		{"exit by moving to another zone", OBSRule{On: obsOnZoneExit, Value: "Home"}, home, work, true},
+		{"never in a zone", OBSRule{On: obsOnZoneExit}, parked, parked, false},
+	}
+	for _, test := range tests {
+		if got := test.rule.matches(test.previous, test.current); got != test.want {
+			t.Errorf("%s: matches = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// startFakeOBS serves a fake OBS over httptest and returns its ws:// address
+func startFakeOBS(t *testing.T, fake *fakeOBS) string {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestDialOBSAuthentication(t *testing.T) {
+	address := startFakeOBS(t, newFakeOBS([]string{"Driving"}, nil, "secret"))
+
+	client, err := dialOBS(address, "secret")
+	if err != nil {
+		t.Fatalf("dialOBS with the right password: %v", err)
+	}
+	if _, err := client.request("GetVersion", nil); err != nil {
+		t.Errorf("GetVersion after identifying: %v", err)
+	}
+	client.close()
+
+	if client, err := dialOBS(address, "wrong"); err == nil {
+		client.close()
+		t.Error("dialOBS with a wrong password succeeded")
+	}
+	if client, err := dialOBS(address, ""); err == nil || !strings.Contains(err.Error(), "requires a password") {
+		if client != nil {
+			client.close()
+		}
+		t.Errorf("dialOBS without a password: err = %v, want a missing password error", err)
+	}
+}
+
+func TestDialOBSWithoutPassword(t *testing.T) {
+	address := startFakeOBS(t, newFakeOBS([]string{"Driving"}, nil, ""))
+
+	client, err := dialOBS(address, "")
+	if err != nil {
+		t.Fatalf("dialOBS: %v", err)
+	}
+	client.close()
+}
+
+func TestApplyOBSRule(t *testing.T) {
+	fake := newFakeOBS([]string{"Driving", "Charging"}, []string{"Map", "Camera"}, "")
+	client, err := dialOBS(startFakeOBS(t, fake), "")
+	if err != nil {
+		t.Fatalf("dialOBS: %v", err)
+	}
+	defer client.close()
+
+	rules := []OBSRule{
+		{On: obsOnState, Value: "charging", Action: obsSwitchScene, Scene: "Charging"},
+		{On: obsOnState, Value: "charging", Action: obsHideSource, Source: "Camera"}, // In the current scene
+	}
+	for _, rule := range rules {
+		if err := applyOBSRule(client, rule); err != nil {
+			t.Fatalf("%s: %v", rule, err)
+		}
+	}
+
+	if err := applyOBSRule(client, OBSRule{Action: obsSwitchScene, Scene: "Missing"}); err == nil {
+		t.Error("switching to a missing scene succeeded")
+	}
+	if err := applyOBSRule(client, OBSRule{Action: obsShowSource, Scene: "Driving", Source: "Missing"}); err == nil {
+		t.Error("showing a missing source succeeded")
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if fake.currentScene != "Charging" {
+		t.Errorf("current scene = %q, want Charging", fake.currentScene)
+	}
+	for scene, items := range fake.items {
+		for _, item := range items {
+			hidden := scene == "Charging" && item.Source == "Camera"
+			if item.Enabled == hidden {
+				t.Errorf("%s in %s: enabled = %v, want %v", item.Source, scene, item.Enabled, !hidden)
+			}
+		}
+	}
+}
+
+func TestEvaluateOBSRulesQueuesInOrder(t *testing.T) {
+	const carID = 7001
+	cfg := defaultConfig()
+	cfg.OBSURL = "ws://localhost:4455"
+	cfg.OBSRules = []OBSRule{
+		{CarID: carID, On: obsOnState, Value: "charging", Action: obsSwitchScene, Scene: "Charging"},
+		{CarID: carID, On: obsOnState, Value: "charging", Action: obsHideSource, Source: "Camera"},
+		{CarID: carID, On: obsOnState, Value: "driving", Action: obsSwitchScene, Scene: "Driving"},
+	}
+	setTestConfig(t, cfg)
+
+	for _, state := range []string{"online", "charging", "driving", "driving"} {
+		evaluateOBSRules(Location{CarID: carID, State: state})
+	}
+
+	var got []string
+	for len(obsRuleQueue) > 0 {
+		for _, rule := range <-obsRuleQueue {
+			got = append(got, rule.Scene+"/"+rule.Action)
+		}
+	}
+	want := []string{"Charging/switch_scene", "/hide_source", "Driving/switch_scene"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("queued rules = %v, want %v", got, want)
+	}
+}
+
+// setTestConfig replaces the running configuration for the rest of the test
+func setTestConfig(t *testing.T, cfg Config) {
+	t.Helper()
+	configMutex.Lock()
+	previous := config
+	config = cfg
+	configMutex.Unlock()
+	t.Cleanup(func() {
+		configMutex.Lock()
+		config = previous
+		configMutex.Unlock()
+	})
+}
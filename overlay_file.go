@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// runOverlayFileWriter keeps Config.OverlayFile and the per-field files in
+// Config.OverlayFieldDir up to date for OBS text sources set to "read from file".
+// The default car is rendered every OverlayFileInterval seconds and whenever a
+// car or config event arrives; files are only rewritten when their text changes.
+func runOverlayFileWriter() {
+	updates := events.subscribe()
+	defer events.unsubscribe(updates)
+
+	written := map[string]string{}
+	for {
+		cfg := getConfig()
+		if cfg.OverlayFile != "" || cfg.OverlayFieldDir != "" {
+			writeOverlayFiles(cfg, written)
+		}
+
+		interval := time.Duration(max(cfg.OverlayFileInterval, 1)) * time.Second
+		select {
+		case <-updates:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func writeOverlayFiles(cfg Config, written map[string]string) {
+	overlayData := buildOverlayData(cfg.DefaultCarID, cfg)
+
+	files := map[string]string{}
+	if cfg.OverlayFile != "" {
+		files[cfg.OverlayFile] = overlayData.Content
+	}
+	if cfg.OverlayFieldDir != "" {
+		for name, text := range overlayFieldTexts(overlayData) {
+			files[filepath.Join(cfg.OverlayFieldDir, name)] = text
+		}
+	}
+
+	for path, text := range files {
+		if previous, ok := written[path]; ok && previous == text {
+			continue
+		}
+		// Atomic so OBS never reads a half-written file
+		if err := writeFileAtomic(path, []byte(text), 0644); err != nil {
+			log.Printf("Error writing overlay file: %v", err)
+			continue
+		}
+		written[path] = text
+	}
+}
+
+// overlayFieldTexts renders one short line per field file. Fields with nothing
+// to show, such as eta.txt without an active route, are written empty so the
+// OBS source disappears.
+func overlayFieldTexts(overlayData OverlayData) map[string]string {
+	texts := map[string]string{
+		"location.txt": overlayData.Content, // The waiting or disabled message until there is data
+		"time.txt":     "",
+		"weather.txt":  "",
+		"eta.txt":      "",
+		"battery.txt":  "",
+		"trip.txt":     "",
+		"charging.txt": "",
+	}
+
+	details := overlayData.Data
+	if details == nil {
+		return texts
+	}
+	units := details.Units
+
+	texts["location.txt"] = details.LocationName
+	texts["time.txt"] = fmt.Sprintf("%s (%s)", details.LocalTime, details.Timezone)
+	texts["weather.txt"] = fmt.Sprintf("%.1f%s, %s", details.Weather.Temperature, details.Weather.TemperatureUnit, details.Weather.Description)
+	texts["battery.txt"] = fmt.Sprintf("%.0f%% (%.0f %s)", details.Battery, details.Range, units.Distance)
+
+	if destination := details.Destination; destination != nil {
+		eta := fmt.Sprintf("%s: %.1f %s, %.0f min", destination.Name, destination.Distance, units.Distance, destination.MinutesToArrival)
+		// Arrival in the car's local time, the destination is almost always in the same zone
+		if now, err := time.Parse("15:04:05", details.LocalTime); err == nil {
+			arrival := now.Add(time.Duration(destination.MinutesToArrival * float64(time.Minute)))
+			eta += ", arriving " + arrival.Format("15:04")
+		}
+		texts["eta.txt"] = eta
+	}
+
+	if charging := details.Charging; charging != nil && charging.Active {
+		text := fmt.Sprintf("%.0f kW, +%.1f kWh, %.0f%% → %.0f%%", charging.Power, charging.EnergyAdded, charging.Battery, charging.ChargeLimit)
+		if charging.MinutesToLimit > 0 {
+			text += fmt.Sprintf(" in %.0f min", charging.MinutesToLimit)
+		}
+		texts["charging.txt"] = text
+	} else if charging != nil {
+		texts["charging.txt"] = fmt.Sprintf("Charged +%.1f kWh in %s", charging.EnergyAdded, formatTripDuration(charging.DurationSeconds))
+	}
+
+	if trip := details.Trip; trip != nil && trip.Active {
+		texts["trip.txt"] = fmt.Sprintf("%.1f %s in %s", trip.Distance, units.Distance, formatTripDuration(trip.MovingSeconds))
+	}
+	return texts
+}
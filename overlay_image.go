@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// OverlayImageOptions sets the look of /overlay.png and /overlay.svg. Every
+// field can be overridden per request with the query parameter named like its
+// JSON key, e.g. /overlay.png?width=640&background=transparent.
+type OverlayImageOptions struct {
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	FontSize   int    `json:"font_size"`  // Pixels, the PNG's bitmap font is scaled in whole multiples of 8
+	Font       string `json:"font"`       // CSS font family for the SVG, the PNG always uses the built-in bitmap font
+	Color      string `json:"color"`      // Text colour, #rgb, #rrggbb or #rrggbbaa
+	Accent     string `json:"accent"`     // Gauge colour
+	Background string `json:"background"` // A colour, or "transparent"
+}
+
+func defaultOverlayImageOptions() OverlayImageOptions {
+	return OverlayImageOptions{
+		Width:      480,
+		Height:     360,
+		FontSize:   16,
+		Font:       "sans-serif",
+		Color:      "#ffffff",
+		Accent:     "#4caf50",
+		Background: "transparent",
+	}
+}
+
+// withDefaults fills in fields left empty, e.g. by a config file written before they existed
+func (o OverlayImageOptions) withDefaults() OverlayImageOptions {
+	defaults := defaultOverlayImageOptions()
+	if o.Width == 0 {
+		o.Width = defaults.Width
+	}
+	if o.Height == 0 {
+		o.Height = defaults.Height
+	}
+	if o.FontSize == 0 {
+		o.FontSize = defaults.FontSize
+	}
+	if o.Font == "" {
+		o.Font = defaults.Font
+	}
+	if o.Color == "" {
+		o.Color = defaults.Color
+	}
+	if o.Accent == "" {
+		o.Accent = defaults.Accent
+	}
+	if o.Background == "" {
+		o.Background = defaults.Background
+	}
+	return o
+}
+
+// overrideFromQuery applies the request's query parameters on top of the configured options
+func (o OverlayImageOptions) overrideFromQuery(query url.Values) (OverlayImageOptions, error) {
+	ints := map[string]*int{"width": &o.Width, "height": &o.Height, "font_size": &o.FontSize}
+	for name, target := range ints {
+		if value := query.Get(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				return o, fmt.Errorf("invalid %s parameter", name)
+			}
+			*target = parsed
+		}
+	}
+	strs := map[string]*string{"font": &o.Font, "color": &o.Color, "accent": &o.Accent, "background": &o.Background}
+	for name, target := range strs {
+		if value := query.Get(name); value != "" {
+			*target = value
+		}
+	}
+	return o, nil
+}
+
+// overlayPalette holds the parsed colours, a transparent background has zero alpha
+type overlayPalette struct {
+	Text       color.NRGBA
+	Accent     color.NRGBA
+	Background color.NRGBA
+}
+
+func (o OverlayImageOptions) palette() (overlayPalette, error) {
+	var p overlayPalette
+	var err error
+	if p.Text, err = parseColor(o.Color); err != nil {
+		return p, fmt.Errorf("color: %w", err)
+	}
+	if p.Accent, err = parseColor(o.Accent); err != nil {
+		return p, fmt.Errorf("accent: %w", err)
+	}
+	if p.Background, err = parseColor(o.Background); err != nil {
+		return p, fmt.Errorf("background: %w", err)
+	}
+	return p, nil
+}
+
+// Largest image visitors without an admin session can ask for in the URL,
+// unless the configured size is larger. A 4K PNG takes 33 MB to render.
+const (
+	overlayImagePublicWidth  = 1920
+	overlayImagePublicHeight = 1080
+)
+
+// checkRequest rejects what a request can't ask for: a font for the PNG, which
+// always uses the pixel font, and a size above overlayImagePublic* and the
+// configured one from visitors without an admin session
+func (o OverlayImageOptions) checkRequest(configured OverlayImageOptions, query url.Values, format string, admin bool) error {
+	if format == "png" && query.Get("font") != "" {
+		return errors.New("the font parameter only applies to overlay.svg, the PNG uses the built-in pixel font")
+	}
+	if admin {
+		return nil
+	}
+	maxWidth := max(overlayImagePublicWidth, configured.Width)
+	maxHeight := max(overlayImagePublicHeight, configured.Height)
+	if o.Width > maxWidth || o.Height > maxHeight {
+		return fmt.Errorf("overlay images are at most %dx%d without an admin session", maxWidth, maxHeight)
+	}
+	return nil
+}
+
+func (o OverlayImageOptions) validate() error {
+	if o.Width < 64 || o.Width > 3840 || o.Height < 64 || o.Height > 2160 {
+		return errors.New("overlay image size must be between 64x64 and 3840x2160")
+	}
+	if o.FontSize < 8 || o.FontSize > 128 {
+		return errors.New("overlay image font size must be between 8 and 128")
+	}
+	_, err := o.palette()
+	return err
+}
+
+// parseColor reads #rgb, #rrggbb or #rrggbbaa (the # is optional, it needs
+// escaping in URLs) or "transparent"
+func parseColor(value string) (color.NRGBA, error) {
+	if strings.EqualFold(value, "transparent") {
+		return color.NRGBA{}, nil
+	}
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid colour %q", value)
+	}
+	return color.NRGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, nil
+}
+
+// overlayCanvas is what the overlay is drawn on, a PNG or an SVG. Angles are in
+// degrees clockwise from north, text is positioned by its baseline.
+type overlayCanvas interface {
+	rect(x, y, w, h float64, c color.NRGBA)
+	arc(cx, cy, r, width, from, to float64, c color.NRGBA) // A full ring when to-from >= 360
+	line(x1, y1, x2, y2, width float64, c color.NRGBA)
+	text(x, y float64, s string, size float64, c color.NRGBA, centered bool)
+}
+
+// Battery levels at or below this are drawn in overlayLowBattery instead of the accent colour
+const overlayLowBatteryLevel = 20
+
+var overlayLowBattery = color.NRGBA{R: 0xf4, G: 0x43, B: 0x36, A: 0xff}
+
+// drawOverlayImage lays out the overlay text with battery, speed and compass
+// gauges along the bottom. Gauges are left out while there's no data, or when
+// the image is too small for them to be legible.
+func drawOverlayImage(canvas overlayCanvas, overlayData OverlayData, opts OverlayImageOptions, p overlayPalette) {
+	width, height := float64(opts.Width), float64(opts.Height)
+	size := float64(opts.FontSize)
+	pad := size * 0.75
+	labelSize := size * 0.75
+
+	if p.Background.A > 0 {
+		canvas.rect(0, 0, width, height, p.Background)
+	}
+
+	textBottom := height - pad
+	cell := (width - 2*pad) / 3
+	diameter := math.Min(cell-pad, height*0.4)
+	if details := overlayData.Data; details != nil && diameter >= 3*size {
+		top := height - pad - labelSize*1.3 - diameter
+		textBottom = top - pad/2
+		drawOverlayGauges(canvas, details, pad+cell/2, top+diameter/2, cell, diameter, size, p)
+	}
+
+	lineHeight := size * 1.3
+	y := pad + size
+	for _, line := range strings.Split(overlayData.Content, "\n") {
+		if y > textBottom {
+			break
+		}
+		canvas.text(pad, y, line, size, p.Text, false)
+		y += lineHeight
+	}
+}
+
+// drawOverlayGauges draws the three gauges centred cell apart, starting at cx
+func drawOverlayGauges(canvas overlayCanvas, details *OverlayDetails, cx, cy, cell, diameter, size float64, p overlayPalette) {
+	stroke := math.Max(2, diameter*0.1)
+	radius := diameter/2 - stroke/2
+	labelSize := size * 0.75
+	labelY := cy + diameter/2 + labelSize*1.3
+	track := p.Text
+	track.A /= 4
+
+	// Battery, a ring filled clockwise from the top
+	battery := math.Max(0, math.Min(details.Battery, 100))
+	batteryColor := p.Accent
+	if battery <= overlayLowBatteryLevel {
+		batteryColor = overlayLowBattery
+	}
+	canvas.arc(cx, cy, radius, stroke, 0, 360, track)
+	if battery > 0 {
+		canvas.arc(cx, cy, radius, stroke, 0, 360*battery/100, batteryColor)
+	}
+	canvas.text(cx, cy+size*0.35, fmt.Sprintf("%.0f%%", battery), size, p.Text, true)
+	canvas.text(cx, labelY, fmt.Sprintf("%.0f %s", details.Range, details.Units.Distance), labelSize, p.Text, true)
+
+	// Speed, a 270° dial with 200 km/h at full scale
+	cx += cell
+	fullScale := details.Units.speed(200)
+	speed := math.Max(0, details.Speed)
+	canvas.arc(cx, cy, radius, stroke, -135, 135, track)
+	if speed > 0 {
+		canvas.arc(cx, cy, radius, stroke, -135, -135+270*math.Min(speed/fullScale, 1), p.Accent)
+	}
+	canvas.text(cx, cy+size*0.35, fmt.Sprintf("%.0f", speed), size, p.Text, true)
+	canvas.text(cx, labelY, details.Units.Speed, labelSize, p.Text, true)
+
+	// Heading, a compass with a needle pointing the way the car faces
+	cx += cell
+	canvas.arc(cx, cy, radius, stroke/2, 0, 360, track)
+	canvas.text(cx, cy-radius+stroke+labelSize, "N", labelSize, p.Text, true)
+	sin, cos := math.Sincos(details.Heading * math.Pi / 180)
+	needle := radius - stroke*1.5
+	canvas.line(cx-sin*needle*0.4, cy+cos*needle*0.4, cx, cy, stroke/2, track)
+	canvas.line(cx, cy, cx+sin*needle, cy-cos*needle, stroke/2, p.Accent)
+	canvas.text(cx, labelY, fmt.Sprintf("%s %.0f°", compassPoint(details.Heading), details.Heading), labelSize, p.Text, true)
+}
+
+// pngCanvas draws with anti-aliased shapes and the bitmap font
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func newPNGCanvas(width, height int) *pngCanvas {
+	return &pngCanvas{img: image.NewRGBA(image.Rect(0, 0, width, height))}
+}
+
+// fill blends c over the pixels in bounds, distance gives each pixel centre's
+// signed distance from the shape's edge (negative inside)
+func (p *pngCanvas) fill(bounds image.Rectangle, c color.NRGBA, distance func(x, y float64) float64) {
+	bounds = bounds.Intersect(p.img.Bounds())
+	if bounds.Empty() {
+		return
+	}
+	mask := image.NewAlpha(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			coverage := math.Max(0, math.Min(1, 0.5-distance(float64(x)+0.5, float64(y)+0.5)))
+			mask.SetAlpha(x, y, color.Alpha{A: uint8(coverage * 255)})
+		}
+	}
+	draw.DrawMask(p.img, bounds, image.NewUniform(c), image.Point{}, mask, bounds.Min, draw.Over)
+}
+
+// around returns the pixels within margin of the box from (x1, y1) to (x2, y2)
+func around(x1, y1, x2, y2, margin float64) image.Rectangle {
+	return image.Rect(
+		int(math.Floor(math.Min(x1, x2)-margin)), int(math.Floor(math.Min(y1, y2)-margin)),
+		int(math.Ceil(math.Max(x1, x2)+margin)), int(math.Ceil(math.Max(y1, y2)+margin)),
+	)
+}
+
+func (p *pngCanvas) rect(x, y, w, h float64, c color.NRGBA) {
+	p.fill(around(x, y, x+w, y+h, 1), c, func(px, py float64) float64 {
+		return math.Max(math.Abs(px-x-w/2)-w/2, math.Abs(py-y-h/2)-h/2)
+	})
+}
+
+func (p *pngCanvas) arc(cx, cy, r, width, from, to float64, c color.NRGBA) {
+	sweep := to - from
+	p.fill(around(cx, cy, cx, cy, r+width), c, func(px, py float64) float64 {
+		if sweep < 360 {
+			angle := math.Atan2(px-cx, cy-py) * 180 / math.Pi
+			if math.Mod(angle-from+720, 360) > sweep {
+				return 1
+			}
+		}
+		return math.Abs(math.Hypot(px-cx, py-cy)-r) - width/2
+	})
+}
+
+func (p *pngCanvas) line(x1, y1, x2, y2, width float64, c color.NRGBA) {
+	dx, dy := x2-x1, y2-y1
+	length2 := dx*dx + dy*dy
+	p.fill(around(x1, y1, x2, y2, width), c, func(px, py float64) float64 {
+		t := 0.0
+		if length2 > 0 {
+			t = math.Max(0, math.Min(1, ((px-x1)*dx+(py-y1)*dy)/length2))
+		}
+		return math.Hypot(px-x1-t*dx, py-y1-t*dy) - width/2
+	})
+}
+
+func (p *pngCanvas) text(x, y float64, s string, size float64, c color.NRGBA, centered bool) {
+	s = bitmapText(s)
+	scale := max(1, int(math.Round(size/8)))
+	advance := 6 * scale
+	left := int(math.Round(x))
+	if centered {
+		left -= (len([]rune(s))*advance - scale) / 2
+	}
+	top := int(math.Round(y)) - 7*scale
+
+	src := image.NewUniform(c)
+	for i, r := range []rune(s) {
+		glyph := overlayFont[r]
+		for row, bits := range glyph {
+			for col := 0; col < 5; col++ {
+				if bits&(0b10000>>col) == 0 {
+					continue
+				}
+				px := left + i*advance + col*scale
+				py := top + row*scale
+				draw.Draw(p.img, image.Rect(px, py, px+scale, py+scale), src, image.Point{}, draw.Over)
+			}
+		}
+	}
+}
+
+// Accented letters and typographic punctuation the bitmap font draws as plain ASCII
+var bitmapFold = map[rune]string{
+	'–': "-", '—': "-", '→': "->", '‘': "'", '’': "'", '“': `"`, '”': `"`, '…': "...", '·': "-", 'ß': "ss",
+}
+
+func init() {
+	accented := []string{"ÀÁÂÃÄÅĀ", "àáâãäåā", "ÇĆČ", "çćč", "ÈÉÊËĒ", "èéêëē", "ÌÍÎÏĪ", "ìíîïī", "Ñ", "ñ", "ÒÓÔÕÖØŌ", "òóôõöøō", "ŠŚ", "šś", "ÙÚÛÜŪ", "ùúûüū", "ÝŸ", "ýÿ", "ŽŹŻ", "žźż"}
+	plain := "AaCcEeIiNnOoSsUuYyZz"
+	for i, letters := range accented {
+		for _, r := range letters {
+			bitmapFold[r] = string(plain[i])
+		}
+	}
+}
+
+// bitmapText rewrites s using only runes in overlayFont. Emoji are dropped, so
+// overlay lines starting with one lose the space that followed it too.
+func bitmapText(s string) string {
+	var b strings.Builder
+	dropped := false // An emoji or symbol was dropped before any text
+	for _, r := range s {
+		switch _, ok := overlayFont[r]; {
+		case ok:
+			b.WriteRune(r)
+		case bitmapFold[r] != "":
+			b.WriteString(bitmapFold[r])
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune('?')
+		default:
+			dropped = dropped || strings.TrimLeft(b.String(), " ") == ""
+		}
+	}
+	if dropped {
+		return strings.TrimLeft(b.String(), " ")
+	}
+	return b.String()
+}
+
+// svgCanvas writes SVG elements, text uses the configured font and keeps emoji
+type svgCanvas struct {
+	body strings.Builder
+}
+
+// paint renders a fill or stroke attribute, with its opacity when the colour isn't opaque
+func paint(attribute string, c color.NRGBA) string {
+	value := fmt.Sprintf(`%s="#%02x%02x%02x"`, attribute, c.R, c.G, c.B)
+	if c.A < 255 {
+		value += fmt.Sprintf(` %s-opacity="%.3f"`, attribute, float64(c.A)/255)
+	}
+	return value
+}
+
+func (s *svgCanvas) rect(x, y, w, h float64, c color.NRGBA) {
+	fmt.Fprintf(&s.body, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" %s/>`+"\n", x, y, w, h, paint("fill", c))
+}
+
+func (s *svgCanvas) arc(cx, cy, r, width, from, to float64, c color.NRGBA) {
+	if to-from >= 360 {
+		fmt.Fprintf(&s.body, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="none" stroke-width="%.1f" %s/>`+"\n", cx, cy, r, width, paint("stroke", c))
+		return
+	}
+	point := func(angle float64) (float64, float64) {
+		sin, cos := math.Sincos(angle * math.Pi / 180)
+		return cx + r*sin, cy - r*cos
+	}
+	x1, y1 := point(from)
+	x2, y2 := point(to)
+	large := 0
+	if to-from > 180 {
+		large = 1
+	}
+	fmt.Fprintf(&s.body, `<path d="M %.1f %.1f A %.1f %.1f 0 %d 1 %.1f %.1f" fill="none" stroke-width="%.1f" %s/>`+"\n",
+		x1, y1, r, r, large, x2, y2, width, paint("stroke", c))
+}
+
+func (s *svgCanvas) line(x1, y1, x2, y2, width float64, c color.NRGBA) {
+	fmt.Fprintf(&s.body, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke-width="%.1f" stroke-linecap="round" %s/>`+"\n",
+		x1, y1, x2, y2, width, paint("stroke", c))
+}
+
+func (s *svgCanvas) text(x, y float64, text string, size float64, c color.NRGBA, centered bool) {
+	anchor := ""
+	if centered {
+		anchor = ` text-anchor="middle"`
+	}
+	fmt.Fprintf(&s.body, `<text x="%.1f" y="%.1f" font-size="%.1f"%s %s>`, x, y, size, anchor, paint("fill", c))
+	xml.EscapeText(&s.body, []byte(text))
+	s.body.WriteString("</text>\n")
+}
+
+func (s *svgCanvas) document(opts OverlayImageOptions) []byte {
+	var doc bytes.Buffer
+	fmt.Fprintf(&doc, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="`,
+		opts.Width, opts.Height, opts.Width, opts.Height)
+	xml.EscapeText(&doc, []byte(opts.Font))
+	doc.WriteString(`" style="white-space:pre">` + "\n")
+	doc.WriteString(s.body.String())
+	doc.WriteString("</svg>\n")
+	return doc.Bytes()
+}
+
+func serveOverlayPNG(w http.ResponseWriter, r *http.Request) {
+	serveOverlayImage(w, r, "png")
+}
+
+func serveOverlaySVG(w http.ResponseWriter, r *http.Request) {
+	serveOverlayImage(w, r, "svg")
+}
+
+// serveOverlayImage renders the overlay server-side for encoders that can't run
+// a browser source
+func serveOverlayImage(w http.ResponseWriter, r *http.Request, format string) {
+	carID, err := requestedCarID(r)
+	if err != nil {
+		http.Error(w, "Invalid car parameter", http.StatusBadRequest)
+		return
+	}
+
+	cfg := getConfig()
+	configured := cfg.OverlayImage.withDefaults()
+	opts, err := configured.overrideFromQuery(r.URL.Query())
+	if err == nil {
+		err = opts.validate()
+	}
+	if err == nil {
+		err = opts.checkRequest(configured, r.URL.Query(), format, hasAdminSession(r))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	palette, _ := opts.palette()
+	overlayData := buildOverlayData(carID, cfg)
+
+	// Image sources poll, they must always get the current state
+	w.Header().Set("Cache-Control", "no-cache")
+	switch format {
+	case "png":
+		canvas := newPNGCanvas(opts.Width, opts.Height)
+		drawOverlayImage(canvas, overlayData, opts, palette)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, canvas.img); err != nil {
+			log.Printf("Error encoding overlay PNG: %v", err)
+			http.Error(w, "Error rendering overlay", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	case "svg":
+		canvas := &svgCanvas{}
+		drawOverlayImage(canvas, overlayData, opts, palette)
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(canvas.document(opts))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestBitmapText(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Speed 80 km/h", "Speed 80 km/h"},
+		{"🔋 72%", "72%"},
+		{"📍 Bunbury → Perth", "Bunbury -> Perth"},
+		{"  Café", "  Cafe"},    // Folding accents changes the length, not the indent
+		{"  Köln 🌧", "  Koln "}, // Only a dropped emoji at the start takes the space with it
+		{"東京", "??"},
+	}
+	for _, test := range tests {
+		if got := bitmapText(test.in); got != test.want {
+			t.Errorf("bitmapText(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestOverlayImageCheckRequest(t *testing.T) {
+	configured := defaultOverlayImageOptions()
+	tests := []struct {
+		name          string
+		query         string
+		format        string
+		admin         bool
+		width, height int
+		ok            bool
+	}{
+		{"default size", "", "png", false, 480, 360, true},
+		{"full HD for visitors", "width=1920&height=1080", "png", false, 1920, 1080, true},
+		{"4K for visitors", "width=3840&height=2160", "png", false, 3840, 2160, false},
+		{"4K for the admin", "width=3840&height=2160", "png", true, 3840, 2160, true},
+		{"font for the SVG", "font=serif", "svg", false, 480, 360, true},
+		{"font for the PNG", "font=serif", "png", true, 480, 360, false},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		opts := configured
+		opts.Width, opts.Height = test.width, test.height
+		if err := opts.checkRequest(configured, query, test.format, test.admin); (err == nil) != test.ok {
+			t.Errorf("%s: err = %v, want ok = %v", test.name, err, test.ok)
+		}
+	}
+
+	// A larger configured size is always allowed
+	configured.Width, configured.Height = 3840, 2160
+	if err := configured.checkRequest(configured, url.Values{}, "png", false); err != nil {
+		t.Errorf("configured 4K size: %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultOverlayTemplate is the built-in overlay layout, used while Config.OverlayTemplate is empty
+const defaultOverlayTemplate = `📍 Location: {{.LocationName}}
+{{- with .Charging}}{{if .Active}}
+⚡ Charging: {{fixed 0 .Power}} kW ({{fixed 0 .Voltage}} V, {{fixed 0 .Current}} A)
+🔋 Battery: {{fixed 0 .Battery}}% → {{fixed 0 .ChargeLimit}}%{{if .MinutesToLimit}}, {{fixed 0 .MinutesToLimit}} min to go{{end}}
+➕ Added: {{fixed 1 .EnergyAdded}} kWh (+{{fixed 0 .RangeAdded}} {{$.Units.Distance}}) in {{duration .DurationSeconds}}
+{{- else}}
+✅ Charged: +{{fixed 1 .EnergyAdded}} kWh, {{fixed 0 .StartBattery}}% → {{fixed 0 .Battery}}% in {{duration .DurationSeconds}} (avg {{fixed 0 .AvgPower}} kW)
+{{- end}}{{end}}
+{{- if .Destination}}
+🎯 Destination: {{.Destination}}
+📏 Distance to Destination: {{fixed 1 .DestinationDistance}} {{.Units.Distance}}
+{{- end}}
+{{- range .References}}
+📏 Distance from {{.Label}}: {{fixed 0 .Distance}} {{$.Units.Distance}}
+{{- end}}
+{{- with .Trip}}{{if .Active}}
+🛣️ Trip: {{fixed 1 .Distance}} {{$.Units.Distance}} in {{duration .MovingSeconds}} ({{duration .StoppedSeconds}} stopped)
+⏱️ Avg Speed: {{fixed 0 .AvgSpeed}} {{$.Units.Speed}} (max {{fixed 0 .MaxSpeed}})
+⛰️ Climb: +{{fixed 0 .ElevationGain}}/-{{fixed 0 .ElevationLoss}} {{$.Units.Elevation}}  🔋 Used: {{fixed 0 .BatteryUsed}}%
+{{- end}}{{end}}
+
+🕒 Local Time: {{.LocalTime}} ({{.Timezone}})
+🌡️ Temperature: {{fixed 1 .Weather.Temperature}}{{.Weather.TemperatureUnit}}
+🌤️ Conditions: {{.Weather.Description}}
+💨 Wind: {{fixed 1 .Weather.WindSpeed}} {{.Weather.WindSpeedUnit}}`
+
+// OverlayView is what overlay templates see. Location is embedded, so its
+// fields (.Battery, .Speed, .Trip, .Units, ...) are available directly, already
+// in the configured units and with privacy zones applied.
+type OverlayView struct {
+	Location
+	LocationName        string              // Place name, or the privacy zone label
+	LocalTime           string              // "15:04:05" at the car
+	Timezone            string              // e.g. "Perth"
+	Weather             WeatherData         // In the configured units
+	DestinationDistance float64             // Distance to the navigation destination in the configured units
+	References          []ReferenceDistance // Home and the other reference points
+}
+
+// overlayFuncs are the helpers available in overlay templates
+var overlayFuncs = template.FuncMap{
+	// Formatting
+	"fixed": func(decimals int, value float64) string {
+		return strconv.FormatFloat(value, 'f', decimals, 64)
+	},
+	"duration": formatTripDuration,
+	"compass":  compassPoint,
+	"date": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+
+	// Unit conversion, for showing a unit other than the configured one
+	"kmToMi":   func(km float64) float64 { return km / kmPerMile },
+	"miToKm":   func(mi float64) float64 { return mi * kmPerMile },
+	"kmhToMph": func(kmh float64) float64 { return kmh / kmPerMile },
+	"mToFt":    func(m float64) float64 { return m * feetPerMetre },
+	"cToF":     func(c float64) float64 { return c*9/5 + 32 },
+	"fToC":     func(f float64) float64 { return (f - 32) * 5 / 9 },
+}
+
+// compassPoint turns a heading in degrees into N, NE, E, ...
+func compassPoint(heading float64) string {
+	directions := []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}
+	index := int(heading/45+0.5) % 8
+	if index < 0 {
+		index += 8
+	}
+	return directions[index]
+}
+
+// buildOverlayView gathers everything the overlay shows for a published location
+func buildOverlayView(loc Location, cfg Config) OverlayView {
+	units := unitsFor(cfg.Units)
+
+	// Get location name (neighborhood/city), inside a privacy zone only its label is shown
+	lat, lon := loc.lookupPosition()
+	locationName := loc.PrivacyZone
+	if locationName == "" {
+		locationName = getLocationName(lat, lon)
+	}
+
+	localTime, timezone := getLocalTime(lat, lon)
+
+	return OverlayView{
+		Location:            loc,
+		LocationName:        locationName,
+		LocalTime:           localTime,
+		Timezone:            timezone,
+		Weather:             getWeather(lat, lon, units),
+		DestinationDistance: units.distance(loc.KmToArrival),
+		References:          referenceDistances(loc, cfg),
+	}
+}
+
+// TemplateError locates a problem in an overlay template
+type TemplateError struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// Parse errors carry the line, execution errors the line and column:
+//
+//	template: overlay:3: unexpected "}" in operand
+//	template: overlay:2:14: executing "overlay" at <.Foo>: can't evaluate field Foo in type main.OverlayView
+var templateErrorPattern = regexp.MustCompile(`(?s)^template: overlay:(\d+)(?::(\d+))?: (?:executing "overlay" )?(.*)$`)
+
+func newTemplateError(err error, text string) *TemplateError {
+	match := templateErrorPattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return &TemplateError{Line: 1, Column: 1, Message: err.Error()}
+	}
+	line, _ := strconv.Atoi(match[1])
+	if match[2] == "" {
+		return &TemplateError{Line: line, Column: guessErrorColumn(text, line), Message: match[3]}
+	}
+
+	// Execution errors count bytes from zero, report characters from one like editors do
+	column, _ := strconv.Atoi(match[2])
+	if lines := strings.Split(text, "\n"); line >= 1 && line <= len(lines) && column <= len(lines[line-1]) {
+		column = utf8.RuneCountInString(lines[line-1][:column])
+	}
+	return &TemplateError{Line: line, Column: column + 1, Message: match[3]}
+}
+
+// guessErrorColumn finds the action a parse error on the given line comes from.
+// text/template only reports the line, so each action on it is parsed on its
+// own; the first that fails for a reason other than a missing or stray
+// {{end}}/{{else}} is the culprit. Falls back to the line's first action.
+func guessErrorColumn(text string, line int) int {
+	lines := strings.Split(text, "\n")
+	if line < 1 || line > len(lines) {
+		return 1
+	}
+	source := lines[line-1]
+
+	first := -1
+	for offset := 0; ; {
+		start := strings.Index(source[offset:], "{{")
+		if start < 0 {
+			break
+		}
+		start += offset
+		if first < 0 {
+			first = start
+		}
+		end := strings.Index(source[start:], "}}")
+		if end < 0 {
+			// Unterminated action
+			return utf8.RuneCountInString(source[:start]) + 1
+		}
+		end += start + 2
+
+		_, err := template.New("action").Funcs(overlayFuncs).Parse(source[start:end])
+		if err != nil && !strings.Contains(err.Error(), "unexpected EOF") && !strings.Contains(err.Error(), "unexpected {{") {
+			return utf8.RuneCountInString(source[:start]) + 1
+		}
+		offset = end
+	}
+	if first < 0 {
+		return 1
+	}
+	return utf8.RuneCountInString(source[:first]) + 1
+}
+
+// sampleOverlayView fills every field so a trial run reaches all of a template's
+// usual branches
+func sampleOverlayView(cfg Config) OverlayView {
+	units := unitsFor(cfg.Units)
+	trip := TripStats{Active: true, StartedAt: time.Now(), DistanceKm: 42, MovingSeconds: 2700, MaxSpeedKmh: 110, AvgSpeedKmh: 56}
+	charging := ChargingSession{Active: true, StartedAt: time.Now(), DurationSeconds: 1500, EnergyAdded: 28.4, Power: 120, MaxPower: 150, AvgPower: 68,
+		Voltage: 390, Current: 308, StartBattery: 35, Battery: 72, ChargeLimit: 80, MinutesToLimit: 12, RangeAddedKm: 180}
+	loc := applyUnits(Location{
+		CarID:            1,
+		DisplayName:      "Tesla",
+		Latitude:         -33.3271,
+		Longitude:        115.6414,
+		Speed:            80,
+		Battery:          72,
+		Range:            310,
+		State:            "driving",
+		Destination:      "Perth",
+		MinutesToArrival: 95,
+		MilesToArrival:   110,
+		UpdatedAt:        time.Now(),
+		Trip:             &trip,
+		Charging:         &charging,
+	}, units)
+	return OverlayView{
+		Location:            loc,
+		LocationName:        "Bunbury, Western Australia",
+		LocalTime:           time.Now().Format("15:04:05"),
+		Timezone:            "Perth",
+		Weather:             WeatherData{Temperature: 21.5, TemperatureUnit: units.Temperature, Description: "Clear sky", WindSpeed: 12, WindSpeedUnit: units.Speed},
+		DestinationDistance: units.distance(loc.KmToArrival),
+		References:          []ReferenceDistance{{Label: "Home", Distance: units.distance(150), DistanceKm: 150}},
+	}
+}
+
+// compileOverlayTemplate parses a template and runs it against sample data, so
+// misspelt fields are caught when the template is saved rather than on stream
+func compileOverlayTemplate(text string, cfg Config) (*template.Template, error) {
+	tmpl, err := template.New("overlay").Funcs(overlayFuncs).Parse(text)
+	if err != nil {
+		return nil, newTemplateError(err, text)
+	}
+	if err := tmpl.Execute(io.Discard, sampleOverlayView(cfg)); err != nil {
+		return nil, newTemplateError(err, text)
+	}
+	return tmpl, nil
+}
+
+var overlayTemplateCache struct {
+	sync.Mutex
+	text     string
+	template *template.Template
+}
+
+// currentOverlayTemplate returns the configured template, compiled once per change
+func currentOverlayTemplate(cfg Config) *template.Template {
+	text := cfg.OverlayTemplate
+	if text == "" {
+		text = defaultOverlayTemplate
+	}
+
+	overlayTemplateCache.Lock()
+	defer overlayTemplateCache.Unlock()
+	if overlayTemplateCache.template != nil && overlayTemplateCache.text == text {
+		return overlayTemplateCache.template
+	}
+
+	tmpl, err := compileOverlayTemplate(text, cfg)
+	if err != nil {
+		// Only possible for a hand-edited config file, the admin panel validates
+		log.Printf("Overlay template error, using the default: %v", err)
+		tmpl = template.Must(template.New("overlay").Funcs(overlayFuncs).Parse(defaultOverlayTemplate))
+	}
+	overlayTemplateCache.text = text
+	overlayTemplateCache.template = tmpl
+	return tmpl
+}
+
+// renderOverlay runs a template, on error the message is shown instead so it is noticed
+func renderOverlay(tmpl *template.Template, view OverlayView) string {
+	var content strings.Builder
+	if err := tmpl.Execute(&content, view); err != nil {
+		log.Printf("Error rendering overlay template: %v", err)
+		return "Overlay template error: " + err.Error()
+	}
+	return content.String()
+}
+
+// serveAdminOverlayTemplate returns the default template (GET) or renders a
+// preview of a draft (POST {"template": "..."}) for the admin page
+func serveAdminOverlayTemplate(w http.ResponseWriter, r *http.Request) {
+	if !requireAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"default": defaultOverlayTemplate})
+	case "POST":
+		var request struct {
+			Template string `json:"template"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		carID, err := requestedCarID(r)
+		if err != nil {
+			http.Error(w, "Invalid car parameter", http.StatusBadRequest)
+			return
+		}
+
+		cfg := getConfig()
+		w.Header().Set("Content-Type", "application/json")
+		tmpl, err := compileOverlayTemplate(request.Template, cfg)
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": err})
+			return
+		}
+
+		// Preview with the car's live data when there is some, the sample otherwise
+		view := sampleOverlayView(cfg)
+		if loc, ok := getPublicLocation(carID); ok {
+			view = buildOverlayView(loc, cfg)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"content": renderOverlay(tmpl, view)})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompileOverlayTemplateErrorPositions(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		line, column int
+		message      string // Part of the message
+	}{
+		{"unknown field", "Speed {{.Speed}}\nBattery {{.Missing}}", 2, 11, "can't evaluate field Missing"},
+		{"columns count characters", "🔋 {{.Missing}}", 1, 5, "can't evaluate field Missing"},
+		{"parse error inside a block", "{{if .Speed}}\nSpeed {{.Speed)}}\n{{end}}", 2, 7, "unexpected"},
+		{"unclosed action", "Hi {{.Speed", 1, 4, "unclosed action"},
+		{"missing end", "{{if .Speed}}fast", 1, 1, "unexpected EOF"},
+		{"unknown function after a valid action", "a {{.Speed}} {{foo .Speed}}", 1, 14, `function "foo" not defined`},
+		{"stray end", "{{.Speed}}\n{{end}}", 2, 1, "unexpected {{end}}"},
+	}
+	for _, test := range tests {
+		_, err := compileOverlayTemplate(test.text, defaultConfig())
+		var templateErr *TemplateError
+		if !errors.As(err, &templateErr) {
+			t.Errorf("%s: err = %v, want a TemplateError", test.name, err)
+			continue
+		}
+		if templateErr.Line != test.line || templateErr.Column != test.column {
+			t.Errorf("%s: error at %d:%d, want %d:%d (%s)", test.name, templateErr.Line, templateErr.Column, test.line, test.column, templateErr.Message)
+		}
+		if !strings.Contains(templateErr.Message, test.message) {
+			t.Errorf("%s: message %q, want it to mention %q", test.name, templateErr.Message, test.message)
+		}
+	}
+}
+
+func TestCompileOverlayTemplateValid(t *testing.T) {
+	for _, text := range []string{defaultOverlayTemplate, "{{.Battery}}% {{if .Trip}}{{.Trip.DistanceKm}}{{end}}"} {
+		if _, err := compileOverlayTemplate(text, defaultConfig()); err != nil {
+			t.Errorf("%q: %v", text, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import "fmt"
+
+// PrivacyZone hides the car's real position while it is inside the zone.
+// A zone is either a circle (centre plus radius) or, when Polygon is set, a polygon.
+type PrivacyZone struct {
+	Name      string       `json:"name"`
+	Label     string       `json:"label"` // Shown instead of the location name, e.g. "Near home"
+	Latitude  float64      `json:"latitude"`
+	Longitude float64      `json:"longitude"`
+	RadiusM   float64      `json:"radius_m"`
+	Polygon   [][2]float64 `json:"polygon,omitempty"` // [latitude, longitude] vertices
+	Mode      string       `json:"mode"`              // "label" or "fuzz"
+}
+
+const (
+	// Report only the zone's label, no coordinates
+	privacyModeLabel = "label"
+	// Report the position snapped to a coarse grid
+	privacyModeFuzz = "fuzz"
+
+	// Grid used by fuzz mode, 0.01° is roughly 1 km
+	privacyFuzzGrid = 0.01
+)
+
+func (z PrivacyZone) contains(lat, lon float64) bool {
+	if len(z.Polygon) >= 3 {
+		return pointInPolygon(lat, lon, z.Polygon)
+	}
+	return calculateDistance(z.Latitude, z.Longitude, lat, lon)*1000 <= z.RadiusM
+}
+
+// centre returns the zone's middle, which label mode uses for server-side lookups
+func (z PrivacyZone) centre() (float64, float64) {
+	if len(z.Polygon) < 3 {
+		return z.Latitude, z.Longitude
+	}
+
+	var lat, lon float64
+	for _, vertex := range z.Polygon {
+		lat += vertex[0]
+		lon += vertex[1]
+	}
+	n := float64(len(z.Polygon))
+	return lat / n, lon / n
+}
+
+func (z PrivacyZone) displayLabel() string {
+	if z.Label != "" {
+		return z.Label
+	}
+	return z.Name
+}
+
+func (z PrivacyZone) validate() error {
+	switch z.Mode {
+	case "", privacyModeLabel, privacyModeFuzz:
+	default:
+		return fmt.Errorf("privacy zone %q: unknown mode %q", z.Name, z.Mode)
+	}
+	if z.Name == "" && z.Label == "" {
+		return fmt.Errorf("privacy zone needs a name or label")
+	}
+	if len(z.Polygon) > 0 && len(z.Polygon) < 3 {
+		return fmt.Errorf("privacy zone %q: polygon needs at least 3 points", z.Name)
+	}
+	if len(z.Polygon) == 0 && z.RadiusM <= 0 {
+		return fmt.Errorf("privacy zone %q: radius must be greater than zero", z.Name)
+	}
+	return nil
+}
+
+// pointInPolygon uses ray casting; zones are small enough to treat lat/lon as planar
+func pointInPolygon(lat, lon float64, polygon [][2]float64) bool {
+	inside := false
+	j := len(polygon) - 1
+	for i := range polygon {
+		latI, lonI := polygon[i][0], polygon[i][1]
+		latJ, lonJ := polygon[j][0], polygon[j][1]
+		if (latI > lat) != (latJ > lat) && lon < (lonJ-lonI)*(lat-latI)/(latJ-latI)+lonI {
+			inside = !inside
+		}
+		j = i
+	}
+	return inside
+}
+
+// findPrivacyZone returns the first zone containing the position
+func findPrivacyZone(lat, lon float64, zones []PrivacyZone) (PrivacyZone, bool) {
+	for _, zone := range zones {
+		if zone.contains(lat, lon) {
+			return zone, true
+		}
+	}
+	return PrivacyZone{}, false
+}
+
+// applyPrivacy returns the location as it may be published. Inside a zone the
+// coordinates are fuzzed or withheld, and the route, destination and movement
+// are hidden.
+func applyPrivacy(loc Location, zones []PrivacyZone) Location {
+	zone, ok := findPrivacyZone(loc.Latitude, loc.Longitude, zones)
+	if !ok {
+		return loc
+	}
+
+	switch zone.Mode {
+	case privacyModeFuzz:
+		loc.Latitude = roundToGrid(loc.Latitude, privacyFuzzGrid)
+		loc.Longitude = roundToGrid(loc.Longitude, privacyFuzzGrid)
+	default:
+		// Weather, time zone and distances are looked up near the zone, but
+		// the published position is 0, 0 and the map hides the car
+		lat, lon := zone.centre()
+		loc.lookupLatitude = roundToGrid(lat, privacyFuzzGrid)
+		loc.lookupLongitude = roundToGrid(lon, privacyFuzzGrid)
+		loc.Latitude, loc.Longitude = 0, 0
+	}
+
+	loc.PrivacyZone = zone.displayLabel()
+	loc.Speed = 0
+	loc.Heading = 0
+	loc.Elevation = 0
+	loc.Destination = ""
+	loc.DestinationLatitude = 0
+	loc.DestinationLongitude = 0
+	loc.MinutesToArrival = 0
+	loc.MilesToArrival = 0
+	loc.EnergyAtArrival = 0
+	return loc
+}
+
+// lookupPosition is where weather, time zone, place and distance lookups for a
+// published location are made, which differs from its coordinates in label mode
+func (loc Location) lookupPosition() (float64, float64) {
+	if loc.lookupLatitude != 0 || loc.lookupLongitude != 0 {
+		return loc.lookupLatitude, loc.lookupLongitude
+	}
+	return loc.Latitude, loc.Longitude
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+var testZones = []PrivacyZone{
+	// Roughly 500 m around a point
+	{Name: "home", Label: "Near home", Latitude: -32.3500, Longitude: 115.8000, RadiusM: 500, Mode: privacyModeLabel},
+	// A square about 2 km across, fuzzed
+	{Name: "work", Polygon: [][2]float64{{-31.95, 115.85}, {-31.95, 115.87}, {-31.97, 115.87}, {-31.97, 115.85}}, Mode: privacyModeFuzz},
+}
+
+func testLocation(lat, lon float64) Location {
+	return Location{
+		CarID:                1,
+		Latitude:             lat,
+		Longitude:            lon,
+		Speed:                12,
+		Heading:              90,
+		Elevation:            30,
+		Destination:          "Supercharger",
+		DestinationLatitude:  -33.33,
+		DestinationLongitude: 115.64,
+		MinutesToArrival:     12,
+		MilesToArrival:       8,
+		EnergyAtArrival:      40,
+	}
+}
+
+func TestApplyPrivacyOutsideZones(t *testing.T) {
+	loc := testLocation(-32.3600, 115.8000) // About 1.1 km south of home
+	if got := applyPrivacy(loc, testZones); got != loc {
+		t.Errorf("applyPrivacy outside every zone changed the location: %+v", got)
+	}
+}
+
+func TestApplyPrivacyCircleLabel(t *testing.T) {
+	got := applyPrivacy(testLocation(-32.3520, 115.8010), testZones)
+	if got.Latitude != 0 || got.Longitude != 0 {
+		t.Errorf("position = %v, %v, want it withheld", got.Latitude, got.Longitude)
+	}
+	if lat, lon := got.lookupPosition(); math.Abs(lat+32.35) > 1e-9 || math.Abs(lon-115.80) > 1e-9 {
+		t.Errorf("lookup position = %v, %v, want the zone centre on the fuzz grid", lat, lon)
+	}
+	if got.PrivacyZone != "Near home" {
+		t.Errorf("privacy zone = %q, want the label", got.PrivacyZone)
+	}
+	assertZoneHidden(t, got)
+}
+
+func TestApplyPrivacyPolygonFuzz(t *testing.T) {
+	for _, position := range [][2]float64{{-31.9512, 115.8533}, {-31.9600, 115.8600}, {-31.9688, 115.8691}} {
+		got := applyPrivacy(testLocation(position[0], position[1]), testZones)
+		for _, value := range []float64{got.Latitude, got.Longitude} {
+			if steps := value / privacyFuzzGrid; math.Abs(steps-math.Round(steps)) > 1e-6 {
+				t.Errorf("%v: %v is not on the fuzz grid", position, value)
+			}
+		}
+		if math.Abs(got.Latitude-position[0]) > privacyFuzzGrid/2+1e-9 || math.Abs(got.Longitude-position[1]) > privacyFuzzGrid/2+1e-9 {
+			t.Errorf("%v: fuzzed to %v, %v, more than half a grid step away", position, got.Latitude, got.Longitude)
+		}
+		if got.PrivacyZone != "work" {
+			t.Errorf("%v: privacy zone = %q, want the name when there is no label", position, got.PrivacyZone)
+		}
+		assertZoneHidden(t, got)
+	}
+}
+
+func TestApplyPrivacyPolygonEdges(t *testing.T) {
+	tests := []struct {
+		lat, lon float64
+		inside   bool
+	}{
+		{-31.9600, 115.8600, true},
+		{-31.9400, 115.8600, false}, // North
+		{-31.9600, 115.8800, false}, // East
+		{-31.9800, 115.8600, false}, // South
+		{-31.9600, 115.8400, false}, // West
+	}
+	for _, test := range tests {
+		_, inside := findPrivacyZone(test.lat, test.lon, testZones[1:])
+		if inside != test.inside {
+			t.Errorf("%v, %v: inside = %v, want %v", test.lat, test.lon, inside, test.inside)
+		}
+	}
+}
+
+func TestPrivacyZoneCentre(t *testing.T) {
+	lat, lon := testZones[1].centre()
+	if math.Abs(lat+31.96) > 1e-9 || math.Abs(lon-115.86) > 1e-9 {
+		t.Errorf("polygon centre = %v, %v, want -31.96, 115.86", lat, lon)
+	}
+}
+
+// assertZoneHidden checks what applyPrivacy blanks in both modes
+func assertZoneHidden(t *testing.T, loc Location) {
+	t.Helper()
+	if loc.Speed != 0 || loc.Heading != 0 || loc.Elevation != 0 {
+		t.Errorf("movement not hidden: speed %v, heading %v, elevation %v", loc.Speed, loc.Heading, loc.Elevation)
+	}
+	if loc.Destination != "" || loc.DestinationLatitude != 0 || loc.DestinationLongitude != 0 ||
+		loc.MinutesToArrival != 0 || loc.MilesToArrival != 0 || loc.EnergyAtArrival != 0 {
+		t.Errorf("route not hidden: %+v", loc)
+	}
+}
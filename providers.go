@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Place is a reverse geocoding result, every Geocoder fills in what it knows
+type Place struct {
+	Suburb      string `json:"suburb"`
+	City        string `json:"city"`
+	State       string `json:"state"`
+	Country     string `json:"country"`
+	CountryCode string `json:"country_code"`
+	DisplayName string `json:"display_name"`
+}
+
+// TimezoneInfo identifies the time zone at a position
+type TimezoneInfo struct {
+	ZoneName     string `json:"zone_name"`
+	Abbreviation string `json:"abbreviation"`
+	GMTOffset    int    `json:"gmt_offset"` // Seconds, used when the zone isn't in the local tz database
+}
+
+// Geocoder turns coordinates into a place name
+type Geocoder interface {
+	Name() string
+	ReverseGeocode(lat, lon float64) (Place, error)
+}
+
+// WeatherProvider reports current conditions in the requested units
+type WeatherProvider interface {
+	Name() string
+	CurrentWeather(lat, lon float64, units UnitSystem) (WeatherData, error)
+}
+
+// TimezoneResolver finds the IANA time zone for a position
+type TimezoneResolver interface {
+	Name() string
+	ResolveTimezone(lat, lon float64) (TimezoneInfo, error)
+}
+
+// Provider names accepted in Config
+const (
+	geocoderNominatim = "nominatim"
+	geocoderPhoton    = "photon"
+
+	weatherOpenMeteo      = "open-meteo"
+	weatherOpenWeatherMap = "openweathermap"
+
+	timezoneTimeZoneDB = "timezonedb"
+
+	providerOffline = "offline" // Local datasets, no network access
+	providerFake    = "fake"    // Canned answers, for testing the overlay offline
+)
+
+// FormattedName renders the place the way the overlay shows it, e.g. "Baldivis, Western Australia"
+func (p Place) FormattedName() string {
+	// Priority order: suburb/neighbourhood -> city/town/village -> state
+	locationParts := []string{}
+	for _, part := range []string{p.Suburb, p.City, p.State} {
+		if part != "" {
+			locationParts = append(locationParts, part)
+		}
+	}
+
+	if len(locationParts) > 0 {
+		if len(locationParts) == 1 {
+			return locationParts[0]
+		}
+		return fmt.Sprintf("%s, %s", locationParts[0], locationParts[len(locationParts)-1])
+	}
+
+	// Fallback to display_name if available
+	if p.DisplayName != "" {
+		// Take first part before first comma (usually the most specific location)
+		return strings.TrimSpace(strings.Split(p.DisplayName, ",")[0])
+	}
+
+	return ""
+}
+
+func currentGeocoder(cfg Config) Geocoder {
+	switch cfg.Geocoder {
+	case geocoderPhoton:
+		return photonGeocoder{baseURL: strings.TrimRight(cfg.GeocoderURL, "/")}
+	case providerOffline:
+		return offlineGeocoder{placesFile: cfg.GeoNamesFile}
+	case providerFake:
+		return fakeGeocoder{}
+	default:
+		return nominatimGeocoder{baseURL: strings.TrimRight(cfg.GeocoderURL, "/")}
+	}
+}
+
+func currentWeatherProvider(cfg Config) WeatherProvider {
+	switch cfg.WeatherProvider {
+	case weatherOpenWeatherMap:
+		return openWeatherMapProvider{apiKey: cfg.OpenWeatherMapToken}
+	case providerFake:
+		return fakeWeatherProvider{}
+	default:
+		return openMeteoProvider{}
+	}
+}
+
+func currentTimezoneResolver(cfg Config) TimezoneResolver {
+	switch cfg.TimezoneProvider {
+	case timezoneTimeZoneDB:
+		return timeZoneDBResolver{apiKey: cfg.TimeZoneDBToken}
+	case providerOffline:
+		return offlineTimezoneResolver{boundaryFile: cfg.TimezoneBoundaryFile}
+	case providerFake:
+		return fakeTimezoneResolver{}
+	default:
+		return autoTimezoneResolver{
+			online:  timeZoneDBResolver{apiKey: cfg.TimeZoneDBToken},
+			offline: offlineTimezoneResolver{boundaryFile: cfg.TimezoneBoundaryFile},
+		}
+	}
+}
+
+func validateProviders(cfg Config) error {
+	switch cfg.Geocoder {
+	case "", geocoderNominatim, geocoderPhoton, providerOffline, providerFake:
+	default:
+		return fmt.Errorf("unknown geocoder %q", cfg.Geocoder)
+	}
+	if cfg.GeocoderURL != "" {
+		if u, err := url.Parse(cfg.GeocoderURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("geocoder URL must be an http(s) URL")
+		}
+	}
+	switch cfg.WeatherProvider {
+	case "", weatherOpenMeteo, weatherOpenWeatherMap, providerFake:
+	default:
+		return fmt.Errorf("unknown weather provider %q", cfg.WeatherProvider)
+	}
+	switch cfg.TimezoneProvider {
+	case "", timezoneAuto, timezoneTimeZoneDB, providerOffline, providerFake:
+	default:
+		return fmt.Errorf("unknown timezone provider %q", cfg.TimezoneProvider)
+	}
+	if cfg.TimezoneProvider == providerOffline && cfg.TimezoneBoundaryFile == "" {
+		return fmt.Errorf("the offline timezone provider needs a timezone boundary file")
+	}
+	return nil
+}
+
+// nominatimGeocoder uses OpenStreetMap's Nominatim, or a self-hosted instance when baseURL is set
+type nominatimGeocoder struct {
+	baseURL string
+}
+
+func (g nominatimGeocoder) Name() string { return geocoderNominatim }
+
+func (g nominatimGeocoder) ReverseGeocode(lat, lon float64) (Place, error) {
+	baseURL := g.baseURL
+	if baseURL == "" {
+		baseURL = "https://nominatim.openstreetmap.org"
+	}
+	url := fmt.Sprintf("%s/reverse?format=json&lat=%.6f&lon=%.6f&zoom=14&addressdetails=1", baseURL, lat, lon)
+
+	var result struct {
+		DisplayName string            `json:"display_name"`
+		Address     map[string]string `json:"address"`
+	}
+	if err := fetchJSON(url, &result); err != nil {
+		return Place{}, err
+	}
+
+	address := result.Address
+	return Place{
+		Suburb:      firstNonEmpty(address["suburb"], address["neighbourhood"]),
+		City:        firstNonEmpty(address["city"], address["town"], address["village"]),
+		State:       address["state"],
+		Country:     address["country"],
+		CountryCode: strings.ToUpper(address["country_code"]),
+		DisplayName: result.DisplayName,
+	}, nil
+}
+
+// photonGeocoder uses Komoot's Photon, or a self-hosted instance when baseURL is set
+type photonGeocoder struct {
+	baseURL string
+}
+
+func (g photonGeocoder) Name() string { return geocoderPhoton }
+
+func (g photonGeocoder) ReverseGeocode(lat, lon float64) (Place, error) {
+	baseURL := g.baseURL
+	if baseURL == "" {
+		baseURL = "https://photon.komoot.io"
+	}
+	url := fmt.Sprintf("%s/reverse?lat=%.6f&lon=%.6f", baseURL, lat, lon)
+
+	var result struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := fetchJSON(url, &result); err != nil {
+		return Place{}, err
+	}
+	if len(result.Features) == 0 {
+		return Place{}, fmt.Errorf("no Photon results")
+	}
+
+	properties := result.Features[0].Properties
+	property := func(key string) string {
+		value, _ := properties[key].(string)
+		return value
+	}
+	return Place{
+		Suburb:      firstNonEmpty(property("district"), property("locality")),
+		City:        property("city"),
+		State:       property("state"),
+		Country:     property("country"),
+		CountryCode: strings.ToUpper(property("countrycode")),
+		DisplayName: property("name"),
+	}, nil
+}
+
+type fakeGeocoder struct{}
+
+func (fakeGeocoder) Name() string { return providerFake }
+
+func (fakeGeocoder) ReverseGeocode(lat, lon float64) (Place, error) {
+	return Place{
+		Suburb:      "Test Suburb",
+		City:        "Test City",
+		State:       "Test State",
+		Country:     "Testland",
+		CountryCode: "TL",
+		DisplayName: fmt.Sprintf("Test Suburb (%.4f, %.4f)", lat, lon),
+	}, nil
+}
+
+// openMeteoProvider uses Open-Meteo (free, no API key required)
+type openMeteoProvider struct{}
+
+func (openMeteoProvider) Name() string { return weatherOpenMeteo }
+
+func (openMeteoProvider) CurrentWeather(lat, lon float64, units UnitSystem) (WeatherData, error) {
+	url := fmt.Sprintf("https://api.open-meteo.com/v1/forecast?latitude=%.4f&longitude=%.4f&current=temperature_2m,relative_humidity_2m,weather_code,wind_speed_10m", lat, lon) + units.openMeteoParams()
+
+	var result struct {
+		Current struct {
+			Temperature float64 `json:"temperature_2m"`
+			Humidity    float64 `json:"relative_humidity_2m"`
+			WeatherCode float64 `json:"weather_code"`
+			WindSpeed   float64 `json:"wind_speed_10m"`
+		} `json:"current"`
+	}
+	if err := fetchJSON(url, &result); err != nil {
+		return WeatherData{}, err
+	}
+
+	return WeatherData{
+		Temperature:     result.Current.Temperature,
+		TemperatureUnit: units.Temperature,
+		Description:     weatherCodeToDescription(int(result.Current.WeatherCode)),
+		Humidity:        int(result.Current.Humidity),
+		WindSpeed:       result.Current.WindSpeed,
+		WindSpeedUnit:   units.Speed,
+	}, nil
+}
+
+// openWeatherMapProvider uses OpenWeatherMap's current weather API (API key required)
+type openWeatherMapProvider struct {
+	apiKey string
+}
+
+func (openWeatherMapProvider) Name() string { return weatherOpenWeatherMap }
+
+func (p openWeatherMapProvider) CurrentWeather(lat, lon float64, units UnitSystem) (WeatherData, error) {
+	if p.apiKey == "" {
+		return WeatherData{}, fmt.Errorf("OpenWeatherMap API key not configured")
+	}
+
+	// Always ask for metric and convert, OpenWeatherMap has no UK-style mix
+	url := fmt.Sprintf("https://api.openweathermap.org/data/2.5/weather?lat=%.4f&lon=%.4f&units=metric&appid=%s", lat, lon, p.apiKey)
+
+	var result struct {
+		Main struct {
+			Temp     float64 `json:"temp"`
+			Humidity int     `json:"humidity"`
+		} `json:"main"`
+		Wind struct {
+			Speed float64 `json:"speed"` // m/s
+		} `json:"wind"`
+		Weather []struct {
+			Description string `json:"description"`
+		} `json:"weather"`
+	}
+	if err := fetchJSON(url, &result); err != nil {
+		return WeatherData{}, err
+	}
+
+	description := "Unknown"
+	if len(result.Weather) > 0 && result.Weather[0].Description != "" {
+		description = strings.ToUpper(result.Weather[0].Description[:1]) + result.Weather[0].Description[1:]
+	}
+
+	temperature := result.Main.Temp
+	if units.Temperature == "°F" {
+		temperature = temperature*9/5 + 32
+	}
+
+	return WeatherData{
+		Temperature:     temperature,
+		TemperatureUnit: units.Temperature,
+		Description:     description,
+		Humidity:        result.Main.Humidity,
+		WindSpeed:       units.speed(result.Wind.Speed * 3.6),
+		WindSpeedUnit:   units.Speed,
+	}, nil
+}
+
+type fakeWeatherProvider struct{}
+
+func (fakeWeatherProvider) Name() string { return providerFake }
+
+func (fakeWeatherProvider) CurrentWeather(lat, lon float64, units UnitSystem) (WeatherData, error) {
+	temperature := 21.5
+	if units.Temperature == "°F" {
+		temperature = temperature*9/5 + 32
+	}
+	return WeatherData{
+		Temperature:     temperature,
+		TemperatureUnit: units.Temperature,
+		Description:     "Clear sky",
+		Humidity:        40,
+		WindSpeed:       units.speed(12),
+		WindSpeedUnit:   units.Speed,
+	}, nil
+}
+
+// timeZoneDBResolver uses the TimeZoneDB API (API key required)
+type timeZoneDBResolver struct {
+	apiKey string
+}
+
+func (timeZoneDBResolver) Name() string { return timezoneTimeZoneDB }
+
+func (r timeZoneDBResolver) ResolveTimezone(lat, lon float64) (TimezoneInfo, error) {
+	url := fmt.Sprintf("http://api.timezonedb.com/v2.1/get-time-zone?key=%s&format=json&by=position&lat=%.6f&lng=%.6f", r.apiKey, lat, lon)
+
+	var result struct {
+		Status       string `json:"status"`
+		Message      string `json:"message"`
+		ZoneName     string `json:"zoneName"`
+		Abbreviation string `json:"abbreviation"`
+		GMTOffset    int    `json:"gmtOffset"`
+	}
+	if err := fetchJSON(url, &result); err != nil {
+		return TimezoneInfo{}, err
+	}
+
+	// Check if the API call was successful
+	if result.Status != "OK" {
+		return TimezoneInfo{}, fmt.Errorf("TimeZoneDB API error: %s", result.Message)
+	}
+
+	info := TimezoneInfo{ZoneName: "UTC", Abbreviation: "UTC", GMTOffset: result.GMTOffset}
+	if result.ZoneName != "" {
+		info.ZoneName = result.ZoneName
+	}
+	if result.Abbreviation != "" {
+		info.Abbreviation = result.Abbreviation
+	}
+	return info, nil
+}
+
+type fakeTimezoneResolver struct{}
+
+func (fakeTimezoneResolver) Name() string { return providerFake }
+
+func (fakeTimezoneResolver) ResolveTimezone(lat, lon float64) (TimezoneInfo, error) {
+	return TimezoneInfo{ZoneName: "Australia/Perth", Abbreviation: "AWST", GMTOffset: 8 * 3600}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package main
+
+import "fmt"
+
+// ReferencePoint is a place the overlay reports the distance from
+type ReferencePoint struct {
+	Label     string  `json:"label"`
+	Type      string  `json:"type"` // "fixed" or "trip_start"
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+const (
+	referenceFixed     = "fixed"
+	referenceTripStart = "trip_start"
+)
+
+func (p ReferencePoint) validate() error {
+	switch p.Type {
+	case "", referenceFixed, referenceTripStart:
+	default:
+		return fmt.Errorf("reference point %q: unknown type %q", p.Label, p.Type)
+	}
+	if p.Label == "" {
+		return fmt.Errorf("reference point needs a label")
+	}
+	return nil
+}
+
+// resolve returns the coordinates of the point for the given car, false if not known yet
+func (p ReferencePoint) resolve(loc Location) (float64, float64, bool) {
+	if p.Type == referenceTripStart {
+		if loc.Trip == nil || (loc.Trip.StartLatitude == 0 && loc.Trip.StartLongitude == 0) {
+			return 0, 0, false
+		}
+		return loc.Trip.StartLatitude, loc.Trip.StartLongitude, true
+	}
+	if p.Latitude == 0 && p.Longitude == 0 {
+		return 0, 0, false
+	}
+	return p.Latitude, p.Longitude, true
+}
+
+// referencePoints lists home (when set) followed by the configured extra points
+func referencePoints(cfg Config) []ReferencePoint {
+	points := []ReferencePoint{}
+	if cfg.HomeLatitude != 0 || cfg.HomeLongitude != 0 {
+		label := cfg.HomeLabel
+		if label == "" {
+			label = "Home"
+		}
+		points = append(points, ReferencePoint{
+			Label:     label,
+			Type:      referenceFixed,
+			Latitude:  cfg.HomeLatitude,
+			Longitude: cfg.HomeLongitude,
+		})
+	}
+	return append(points, cfg.ReferencePoints...)
+}
+
+// ReferenceDistance is how far the car is from a reference point
+type ReferenceDistance struct {
+	Label      string  `json:"label"`
+	Distance   float64 `json:"distance"` // In the configured units
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// referenceDistances lists the distance to every resolvable reference point
+func referenceDistances(loc Location, cfg Config) []ReferenceDistance {
+	units := unitsFor(cfg.Units)
+
+	carLat, carLon := loc.lookupPosition()
+	distances := []ReferenceDistance{}
+	for _, point := range referencePoints(cfg) {
+		lat, lon, ok := point.resolve(loc)
+		if !ok {
+			continue
+		}
+		km := calculateDistance(lat, lon, carLat, carLon)
+		distances = append(distances, ReferenceDistance{Label: point.Label, Distance: units.distance(km), DistanceKm: km})
+	}
+	return distances
+}
@@ -12,12 +12,18 @@ get_config() {
     curl -s http://localhost:8081/config | jq -r '.map_enabled'
 }
 
-# Function to set config
+# Log in to the admin interface so config changes are accepted
+COOKIE_JAR=$(mktemp)
+trap 'rm -f "$COOKIE_JAR"' EXIT
+curl -s -c "$COOKIE_JAR" -d "username=$ADMIN_USERNAME&password=$ADMIN_PASSWORD" \
+    http://localhost:8081/admin/login > /dev/null
+
+# Function to set config (fields not sent keep their current values)
 set_config() {
     local map_enabled=$1
-    curl -s -X POST http://localhost:8081/config \
+    curl -s -b "$COOKIE_JAR" -X POST http://localhost:8081/admin/config \
         -H "Content-Type: application/json" \
-        -d "{\"show_route\": true, \"mapbox_token\": \"$MAPBOX_TOKEN\", \"map_enabled\": $map_enabled, \"timezonedb_token\": \"$TIMEZONEDB_TOKEN\"}" \
+        -d "{\"map_enabled\": $map_enabled}" \
         > /dev/null
 }
 
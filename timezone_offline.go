@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	// Embed the IANA tz database so time.LoadLocation works on hosts without zoneinfo
+	_ "time/tzdata"
+)
+
+// timezoneAuto uses TimeZoneDB when a token is set, offline otherwise or when it fails
+const timezoneAuto = "auto"
+
+// errNoTimezoneBoundaries is returned when offline lookups have no boundary file
+var errNoTimezoneBoundaries = errors.New("no time zone boundary file configured (TZ_BOUNDARY_FILE)")
+
+// offlineTimezoneResolver maps positions to IANA zones without network access.
+// Zone polygons come from a timezone-boundary-builder GeoJSON release
+// (https://github.com/evansiroky/timezone-boundary-builder), which is required.
+// Positions outside every polygon get the nautical zone for their longitude
+// (Etc/GMT±N).
+type offlineTimezoneResolver struct {
+	boundaryFile string
+}
+
+func (offlineTimezoneResolver) Name() string { return providerOffline }
+
+func (r offlineTimezoneResolver) ResolveTimezone(lat, lon float64) (TimezoneInfo, error) {
+	if r.boundaryFile == "" {
+		return TimezoneInfo{}, errNoTimezoneBoundaries
+	}
+	boundaries, err := loadTimezoneBoundaries(r.boundaryFile)
+	if err != nil {
+		return TimezoneInfo{}, err
+	}
+	if zone, ok := boundaries.lookup(lat, lon); ok {
+		return timezoneInfoFor(zone), nil
+	}
+	return nauticalTimezone(lon), nil
+}
+
+// autoTimezoneResolver prefers TimeZoneDB and falls back to the offline resolver
+type autoTimezoneResolver struct {
+	online  timeZoneDBResolver
+	offline offlineTimezoneResolver
+}
+
+func (autoTimezoneResolver) Name() string { return timezoneAuto }
+
+func (r autoTimezoneResolver) ResolveTimezone(lat, lon float64) (TimezoneInfo, error) {
+	if r.online.apiKey != "" {
+		info, err := r.online.ResolveTimezone(lat, lon)
+		if err == nil {
+			return info, nil
+		}
+		log.Printf("TimeZoneDB failed, resolving offline: %v", err)
+	}
+	return r.offline.ResolveTimezone(lat, lon)
+}
+
+// timezoneInfoFor fills in the current abbreviation and offset of an IANA zone
+func timezoneInfoFor(zoneName string) TimezoneInfo {
+	loc, err := time.LoadLocation(zoneName)
+	if err != nil {
+		return TimezoneInfo{ZoneName: zoneName, Abbreviation: zoneName}
+	}
+	abbreviation, offset := time.Now().In(loc).Zone()
+	return TimezoneInfo{ZoneName: zoneName, Abbreviation: abbreviation, GMTOffset: offset}
+}
+
+// nauticalTimezone returns the Etc/GMT zone for a longitude. Note the POSIX
+// sign convention: Etc/GMT-8 is eight hours ahead of UTC.
+func nauticalTimezone(lon float64) TimezoneInfo {
+	hours := int(math.Round(lon / 15))
+	if hours == 0 {
+		return timezoneInfoFor("Etc/UTC")
+	}
+	return timezoneInfoFor(fmt.Sprintf("Etc/GMT%+d", -hours))
+}
+
+// timezoneRing is a closed ring of [lon, lat] points as stored in GeoJSON
+type timezoneRing [][2]float64
+
+type timezonePolygon struct {
+	zone           string
+	rings          []timezoneRing // First ring is the outline, the rest are holes
+	minLat, maxLat float64
+	minLon, maxLon float64
+}
+
+type timezoneBoundaries struct {
+	polygons []timezonePolygon
+}
+
+// timezoneBoundaryRetry is how long a file that failed to load is left alone
+const timezoneBoundaryRetry = 10 * time.Minute
+
+type timezoneBoundaryFailure struct {
+	err    error
+	failed time.Time
+}
+
+var (
+	timezoneBoundaryCache    = map[string]*timezoneBoundaries{}
+	timezoneBoundaryFailures = map[string]timezoneBoundaryFailure{}
+	timezoneBoundaryMutex    sync.Mutex
+)
+
+// loadTimezoneBoundaries parses the boundary file once and keeps it in memory.
+// A file that fails to load is only retried after timezoneBoundaryRetry.
+func loadTimezoneBoundaries(path string) (*timezoneBoundaries, error) {
+	timezoneBoundaryMutex.Lock()
+	defer timezoneBoundaryMutex.Unlock()
+
+	if boundaries, ok := timezoneBoundaryCache[path]; ok {
+		return boundaries, nil
+	}
+	if failure, ok := timezoneBoundaryFailures[path]; ok && time.Since(failure.failed) < timezoneBoundaryRetry {
+		return nil, failure.err
+	}
+
+	boundaries, err := readTimezoneBoundaries(path)
+	if err != nil {
+		log.Printf("Failed to load timezone boundaries: %v", err)
+		timezoneBoundaryFailures[path] = timezoneBoundaryFailure{err: err, failed: time.Now()}
+		return nil, err
+	}
+	delete(timezoneBoundaryFailures, path)
+
+	log.Printf("Loaded %d timezone polygons from %s", len(boundaries.polygons), path)
+	timezoneBoundaryCache[path] = boundaries
+	return boundaries, nil
+}
+
+// readTimezoneBoundaries decodes the GeoJSON one feature at a time, so only
+// the parsed polygons are held in memory rather than the whole file as well
+func readTimezoneBoundaries(path string) (*timezoneBoundaries, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	if err := expectJSONDelim(decoder, '{'); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	boundaries := &timezoneBoundaries{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if token != "features" {
+			var skipped json.RawMessage
+			if err := decoder.Decode(&skipped); err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", path, err)
+			}
+			continue
+		}
+
+		if err := expectJSONDelim(decoder, '['); err != nil {
+			return nil, fmt.Errorf("parsing %s features: %w", path, err)
+		}
+		for decoder.More() {
+			var feature timezoneFeature
+			if err := decoder.Decode(&feature); err != nil {
+				return nil, fmt.Errorf("parsing %s: %w", path, err)
+			}
+			if err := boundaries.add(feature); err != nil {
+				return nil, err
+			}
+		}
+		if err := expectJSONDelim(decoder, ']'); err != nil {
+			return nil, fmt.Errorf("parsing %s features: %w", path, err)
+		}
+	}
+	return boundaries, nil
+}
+
+func expectJSONDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v, found %v", delim, token)
+	}
+	return nil
+}
+
+type timezoneFeature struct {
+	Properties struct {
+		TZID string `json:"tzid"`
+	} `json:"properties"`
+	Geometry struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+// add indexes the polygons of one GeoJSON feature
+func (b *timezoneBoundaries) add(feature timezoneFeature) error {
+	var polygons [][]timezoneRing
+	switch feature.Geometry.Type {
+	case "Polygon":
+		var polygon []timezoneRing
+		if err := json.Unmarshal(feature.Geometry.Coordinates, &polygon); err != nil {
+			return fmt.Errorf("parsing %s geometry: %w", feature.Properties.TZID, err)
+		}
+		polygons = append(polygons, polygon)
+	case "MultiPolygon":
+		if err := json.Unmarshal(feature.Geometry.Coordinates, &polygons); err != nil {
+			return fmt.Errorf("parsing %s geometry: %w", feature.Properties.TZID, err)
+		}
+	default:
+		return nil
+	}
+
+	for _, rings := range polygons {
+		if len(rings) == 0 {
+			continue
+		}
+		b.polygons = append(b.polygons, newTimezonePolygon(feature.Properties.TZID, rings))
+	}
+	return nil
+}
+
+func newTimezonePolygon(zone string, rings []timezoneRing) timezonePolygon {
+	polygon := timezonePolygon{
+		zone:   zone,
+		rings:  rings,
+		minLat: math.Inf(1), maxLat: math.Inf(-1),
+		minLon: math.Inf(1), maxLon: math.Inf(-1),
+	}
+	for _, point := range rings[0] {
+		polygon.minLon = math.Min(polygon.minLon, point[0])
+		polygon.maxLon = math.Max(polygon.maxLon, point[0])
+		polygon.minLat = math.Min(polygon.minLat, point[1])
+		polygon.maxLat = math.Max(polygon.maxLat, point[1])
+	}
+	return polygon
+}
+
+func (b *timezoneBoundaries) lookup(lat, lon float64) (string, bool) {
+	for _, polygon := range b.polygons {
+		if lat < polygon.minLat || lat > polygon.maxLat || lon < polygon.minLon || lon > polygon.maxLon {
+			continue
+		}
+		if polygon.contains(lat, lon) {
+			return polygon.zone, true
+		}
+	}
+	return "", false
+}
+
+func (p timezonePolygon) contains(lat, lon float64) bool {
+	if !ringContains(p.rings[0], lat, lon) {
+		return false
+	}
+	for _, hole := range p.rings[1:] {
+		if ringContains(hole, lat, lon) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains is a ray casting test on a GeoJSON [lon, lat] ring
+func ringContains(ring timezoneRing, lat, lon float64) bool {
+	inside := false
+	j := len(ring) - 1
+	for i := range ring {
+		lonI, latI := ring[i][0], ring[i][1]
+		lonJ, latJ := ring[j][0], ring[j][1]
+		if (latI > lat) != (latJ > lat) && lon < (lonJ-lonI)*(lat-latI)/(latJ-latI)+lonI {
+			inside = !inside
+		}
+		j = i
+	}
+	return inside
+}
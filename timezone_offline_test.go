@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A square zone around Perth with a hole, and a feature that isn't a polygon
+const testTimezoneBoundaries = `{
+	"type": "FeatureCollection",
+	"features": [
+		{"type": "Feature", "properties": {"tzid": "Australia/Perth"}, "geometry": {"type": "Polygon", "coordinates": [
+			[[115, -33], [117, -33], [117, -31], [115, -31], [115, -33]],
+			[[115.9, -32.1], [116.1, -32.1], [116.1, -31.9], [115.9, -31.9], [115.9, -32.1]]
+		]}},
+		{"type": "Feature", "properties": {"tzid": "Australia/Eucla"}, "geometry": {"type": "Point", "coordinates": [128.9, -31.7]}}
+	],
+	"name": "test"
+}`
+
+func TestOfflineTimezoneResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timezones.json")
+	if err := os.WriteFile(path, []byte(testTimezoneBoundaries), 0600); err != nil {
+		t.Fatal(err)
+	}
+	resolver := offlineTimezoneResolver{boundaryFile: path}
+
+	tests := []struct {
+		lat, lon float64
+		zone     string
+	}{
+		{-32.5, 115.8, "Australia/Perth"},
+		{-32.0, 116.0, "Etc/GMT-8"}, // In the hole
+		{-31.7, 128.9, "Etc/GMT-9"}, // Only a point, outside every polygon
+	}
+	for _, test := range tests {
+		info, err := resolver.ResolveTimezone(test.lat, test.lon)
+		if err != nil {
+			t.Fatalf("%v, %v: %v", test.lat, test.lon, err)
+		}
+		if info.ZoneName != test.zone {
+			t.Errorf("%v, %v: zone = %q, want %q", test.lat, test.lon, info.ZoneName, test.zone)
+		}
+	}
+
+	if _, err := (offlineTimezoneResolver{}).ResolveTimezone(-32.5, 115.8); !errors.Is(err, errNoTimezoneBoundaries) {
+		t.Errorf("without a file: err = %v, want errNoTimezoneBoundaries", err)
+	}
+}
+
+func TestLoadTimezoneBoundariesCachesFailures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timezones.json")
+	if err := os.WriteFile(path, []byte(`{"features": [{"geometry": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTimezoneBoundaries(path); err == nil {
+		t.Fatal("truncated file loaded")
+	}
+
+	// Fixed on disk, but not read again until the retry interval has passed
+	if err := os.WriteFile(path, []byte(testTimezoneBoundaries), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTimezoneBoundaries(path); err == nil {
+		t.Error("failed file was read again straight away")
+	}
+	timezoneBoundaryMutex.Lock()
+	failure := timezoneBoundaryFailures[path]
+	failure.failed = failure.failed.Add(-timezoneBoundaryRetry)
+	timezoneBoundaryFailures[path] = failure
+	timezoneBoundaryMutex.Unlock()
+	if _, err := loadTimezoneBoundaries(path); err != nil {
+		t.Errorf("after the retry interval: %v", err)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrailPoint is one recorded position. Speed and Elevation are in Teslamate's
+// units (km/h, m) like the raw Location.
+type TrailPoint struct {
+	CarID     int       `json:"car_id"`
+	Time      time.Time `json:"time"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Speed     float64   `json:"speed"`
+	Heading   float64   `json:"heading"`
+	Elevation float64   `json:"elevation"`
+	Battery   float64   `json:"battery"`
+	State     string    `json:"state"`
+	Segment   int64     `json:"segment"` // Unix time the drive or stop began, shared by all its points
+}
+
+// trailGap starts a new segment when positions stop arriving for this long,
+// e.g. the server was down or the car slept without reporting a state change
+const trailGap = 10 * time.Minute
+
+// trailPublicWindow is how far back /trail reaches for visitors without an admin session
+const trailPublicWindow = 24 * time.Hour
+
+var (
+	trailFile      = os.Getenv("TRAIL_FILE") // Optional JSON lines file, the trail survives restarts when set
+	trailMaxPoints = trailMaxPointsFromEnv()
+	trails         = map[int]*trailBuffer{}
+	trailMutex     sync.RWMutex
+
+	pendingTrailPoints = map[int]bool{}
+	pendingTrailMutex  sync.Mutex
+)
+
+func trailMaxPointsFromEnv() int {
+	if n, err := strconv.Atoi(os.Getenv("TRAIL_MAX_POINTS")); err == nil && n > 0 {
+		return n
+	}
+	return 20000 // About five and a half hours of driving at one fix per second
+}
+
+// trailBuffer is a ring buffer of at most size points, the oldest are overwritten
+type trailBuffer struct {
+	points []TrailPoint
+	size   int
+	start  int
+}
+
+func newTrailBuffer(size int) *trailBuffer {
+	return &trailBuffer{size: size}
+}
+
+func (b *trailBuffer) add(point TrailPoint) {
+	if len(b.points) < b.size {
+		b.points = append(b.points, point)
+		return
+	}
+	b.points[b.start] = point
+	b.start = (b.start + 1) % b.size
+}
+
+func (b *trailBuffer) last() (TrailPoint, bool) {
+	if len(b.points) == 0 {
+		return TrailPoint{}, false
+	}
+	return b.points[(b.start+len(b.points)-1)%len(b.points)], true
+}
+
+// since returns the points recorded at or after t, oldest first
+func (b *trailBuffer) since(t time.Time) []TrailPoint {
+	points := []TrailPoint{}
+	for i := range b.points {
+		point := b.points[(b.start+i)%len(b.points)]
+		if !point.Time.Before(t) {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// queuePositionSample records the car's position in the trail and trip, and
+// runs OBS rules and region events, shortly after a position, state, battery or elevation message,
+// so the separately published values land in one sample
+func queuePositionSample(carID int) {
+	pendingTrailMutex.Lock()
+	defer pendingTrailMutex.Unlock()
+	if pendingTrailPoints[carID] {
+		return
+	}
+	pendingTrailPoints[carID] = true
+
+	time.AfterFunc(carEventDelay, func() {
+		pendingTrailMutex.Lock()
+		delete(pendingTrailPoints, carID)
+		pendingTrailMutex.Unlock()
+
+		if loc, ok := getCarLocation(carID); ok {
+			recordTrailPoint(loc)
+			sampleTrip(loc)
+			evaluateOBSRules(loc)
+			checkRegion(loc)
+		}
+	})
+}
+
+func recordTrailPoint(loc Location) {
+	if loc.Latitude == 0 && loc.Longitude == 0 {
+		return
+	}
+
+	point := TrailPoint{
+		CarID:     loc.CarID,
+		Time:      time.Now().UTC(),
+		Latitude:  loc.Latitude,
+		Longitude: loc.Longitude,
+		Speed:     loc.Speed,
+		Heading:   loc.Heading,
+		Elevation: loc.Elevation,
+		Battery:   loc.Battery,
+		State:     loc.State,
+	}
+
+	trailMutex.Lock()
+	buffer, ok := trails[loc.CarID]
+	if !ok {
+		buffer = newTrailBuffer(trailMaxPoints)
+		trails[loc.CarID] = buffer
+	}
+	last, hasLast := buffer.last()
+	if hasLast && last.Latitude == point.Latitude && last.Longitude == point.Longitude && last.State == point.State {
+		trailMutex.Unlock()
+		return
+	}
+	// Each drive, and each stop between drives, is its own segment
+	if hasLast && (last.State == "driving") == (point.State == "driving") && point.Time.Sub(last.Time) < trailGap {
+		point.Segment = last.Segment
+	} else {
+		point.Segment = max(point.Time.Unix(), last.Segment+1)
+	}
+	buffer.add(point)
+	trailMutex.Unlock()
+
+	if trailFile != "" {
+		appendTrailFile(point)
+	}
+}
+
+// trailFilter selects points by time range and, optionally, a single drive or stop
+type trailFilter struct {
+	Since   time.Time
+	Until   time.Time // Zero means up to now
+	Segment int64     // Zero means every segment
+}
+
+func (f trailFilter) matches(point TrailPoint) bool {
+	if !f.Until.IsZero() && point.Time.After(f.Until) {
+		return false
+	}
+	return f.Segment == 0 || point.Segment == f.Segment
+}
+
+// getTrail returns a copy of the car's recorded points that pass the filter, oldest first
+func getTrail(carID int, filter trailFilter) []TrailPoint {
+	trailMutex.RLock()
+	defer trailMutex.RUnlock()
+
+	buffer, ok := trails[carID]
+	if !ok {
+		return []TrailPoint{}
+	}
+	points := []TrailPoint{}
+	for _, point := range buffer.since(filter.Since) {
+		if filter.matches(point) {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+func appendTrailFile(point TrailPoint) {
+	data, err := json.Marshal(point)
+	if err != nil {
+		log.Printf("Error encoding trail point: %v", err)
+		return
+	}
+
+	file, err := os.OpenFile(trailFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Error opening trail file: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing trail file: %v", err)
+	}
+}
+
+// loadTrail restores the ring buffers from TRAIL_FILE and compacts the file
+// once it holds more than twice what the buffers keep
+func loadTrail() error {
+	if trailFile == "" {
+		return nil
+	}
+
+	lines, err := readTrailFile(trailFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	trailMutex.Lock()
+	defer trailMutex.Unlock()
+
+	kept := 0
+	var compacted []byte
+	for _, buffer := range trails {
+		kept += len(buffer.points)
+		for _, point := range buffer.since(time.Time{}) {
+			data, _ := json.Marshal(point)
+			compacted = append(append(compacted, data...), '\n')
+		}
+	}
+	log.Printf("Loaded %d trail points from %s", kept, trailFile)
+
+	if lines > 2*kept {
+		if err := writeFileAtomic(trailFile, compacted, 0600); err != nil {
+			return fmt.Errorf("compacting %s: %w", trailFile, err)
+		}
+	}
+	return nil
+}
+
+// readTrailFile adds every point in a JSON lines trail file to the ring buffers
+// and returns how many lines it read
+func readTrailFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	trailMutex.Lock()
+	defer trailMutex.Unlock()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var point TrailPoint
+		if err := json.Unmarshal(scanner.Bytes(), &point); err != nil {
+			continue
+		}
+		buffer, ok := trails[point.CarID]
+		if !ok {
+			buffer = newTrailBuffer(trailMaxPoints)
+			trails[point.CarID] = buffer
+		}
+		buffer.add(point)
+		lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return lines, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return lines, nil
+}
+
+// trailTracks splits points into one track per segment. Points inside a privacy
+// zone are dropped and the track is broken there, so no line leads into the zone.
+func trailTracks(points []TrailPoint, zones []PrivacyZone) [][]TrailPoint {
+	var tracks [][]TrailPoint
+	var current []TrailPoint
+	for _, point := range points {
+		if _, hidden := findPrivacyZone(point.Latitude, point.Longitude, zones); hidden {
+			if len(current) > 0 {
+				tracks = append(tracks, current)
+				current = nil
+			}
+			continue
+		}
+		if len(current) > 0 && current[0].Segment != point.Segment {
+			tracks = append(tracks, current)
+			current = nil
+		}
+		current = append(current, point)
+	}
+	if len(current) > 0 {
+		tracks = append(tracks, current)
+	}
+	return tracks
+}
+
+// trackDistance sums the distance between successive points in km
+func trackDistance(track []TrailPoint) float64 {
+	distance := 0.0
+	for i := 1; i < len(track); i++ {
+		distance += calculateDistance(track[i-1].Latitude, track[i-1].Longitude, track[i].Latitude, track[i].Longitude)
+	}
+	return distance
+}
+
+// parseTrailTime accepts RFC 3339, Unix seconds, or a duration such as "6h" meaning that long ago
+func parseTrailTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if d, err := time.ParseDuration(strings.TrimPrefix(value, "-")); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+// parseTrailFilter reads the since, until and segment parameters shared by /trail and the exports
+func parseTrailFilter(query url.Values) (trailFilter, error) {
+	var filter trailFilter
+	var err error
+	if filter.Since, err = parseTrailTime(query.Get("since")); err != nil {
+		return filter, fmt.Errorf("invalid since parameter")
+	}
+	if filter.Until, err = parseTrailTime(query.Get("until")); err != nil {
+		return filter, fmt.Errorf("invalid until parameter")
+	}
+	if segment := query.Get("segment"); segment != "" {
+		if filter.Segment, err = strconv.ParseInt(segment, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid segment parameter")
+		}
+	}
+	return filter, nil
+}
+
+// trailFeatureCollection renders tracks as GeoJSON, one LineString per track
+func trailFeatureCollection(carID int, tracks [][]TrailPoint) map[string]interface{} {
+	features := []map[string]interface{}{}
+	for _, track := range tracks {
+		// A LineString needs two positions, a stop usually has only one
+		if len(track) < 2 {
+			continue
+		}
+		coordinates := make([][]float64, len(track))
+		for i, point := range track {
+			coordinates[i] = []float64{point.Longitude, point.Latitude, point.Elevation}
+		}
+		state := "parked"
+		if track[0].State == "driving" {
+			state = "driving"
+		}
+		features = append(features, map[string]interface{}{
+			"type": "Feature",
+			"geometry": map[string]interface{}{
+				"type":        "LineString",
+				"coordinates": coordinates,
+			},
+			"properties": map[string]interface{}{
+				"car_id":      carID,
+				"segment":     track[0].Segment,
+				"state":       state,
+				"start":       track[0].Time,
+				"end":         track[len(track)-1].Time,
+				"points":      len(track),
+				"distance_km": trackDistance(track),
+			},
+		})
+	}
+
+	return map[string]interface{}{
+		"type":     "FeatureCollection",
+		"features": features,
+	}
+}
+
+// authorizeTrail lets the admin read the whole trail, and visitors the last
+// trailPublicWindow when PublicTrail is set. It answers requests it refuses.
+func authorizeTrail(w http.ResponseWriter, r *http.Request, cfg Config, filter *trailFilter) bool {
+	if hasAdminSession(r) {
+		return true
+	}
+	if !cfg.PublicTrail {
+		http.Error(w, "The trail is only available to the admin.", http.StatusUnauthorized)
+		return false
+	}
+	if earliest := time.Now().Add(-trailPublicWindow); filter.Since.Before(earliest) {
+		filter.Since = earliest
+	}
+	return true
+}
+
+// serveTrail returns the recorded trail as a GeoJSON FeatureCollection with one
+// LineString per drive or stop
+func serveTrail(w http.ResponseWriter, r *http.Request) {
+	cfg := getConfig()
+	if !cfg.MapEnabled {
+		http.Error(w, "Map is disabled in configuration.", http.StatusForbidden)
+		return
+	}
+
+	carID, err := requestedCarID(r)
+	if err != nil {
+		http.Error(w, "Invalid car parameter", http.StatusBadRequest)
+		return
+	}
+	filter, err := parseTrailFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeTrail(w, r, cfg, &filter) {
+		return
+	}
+
+	tracks := trailTracks(getTrail(carID, filter), cfg.PrivacyZones)
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(trailFeatureCollection(carID, tracks))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// recordTestPoints records positions for a car that no other test uses,
+// ageing the trail by gap before each one
+func recordTestPoints(t *testing.T, carID int, samples []Location, gaps []time.Duration) []TrailPoint {
+	t.Helper()
+	t.Cleanup(func() {
+		trailMutex.Lock()
+		delete(trails, carID)
+		trailMutex.Unlock()
+	})
+	for i, loc := range samples {
+		trailMutex.Lock()
+		if buffer, ok := trails[carID]; ok {
+			for j := range buffer.points {
+				buffer.points[j].Time = buffer.points[j].Time.Add(-gaps[i])
+			}
+		}
+		trailMutex.Unlock()
+		loc.CarID = carID
+		recordTrailPoint(loc)
+	}
+	return getTrail(carID, trailFilter{})
+}
+
+func TestRecordTrailPointSegments(t *testing.T) {
+	at := func(lat float64, state string) Location {
+		return Location{Latitude: lat, Longitude: 115.8, State: state}
+	}
+	samples := []Location{
+		at(-32.30, "online"),
+		at(-32.31, "driving"), // Starts a drive
+		at(-32.32, "driving"),
+		at(-32.33, "driving"), // After a 10 minute gap, a new drive
+		at(-32.33, "driving"), // Same position and state, not recorded
+		at(-32.34, "online"),  // Parked
+		at(-32.34, "asleep"),  // Still not driving, same stop
+	}
+	gaps := []time.Duration{0, time.Second, time.Second, trailGap, time.Second, time.Second, time.Second}
+	points := recordTestPoints(t, 9001, samples, gaps)
+
+	if len(points) != 6 {
+		t.Fatalf("recorded %d points, want 6: %+v", len(points), points)
+	}
+	want := []int{0, 1, 1, 2, 3, 3} // Index of each point's segment
+	segments := map[int64]int{}
+	for i, point := range points {
+		if _, ok := segments[point.Segment]; !ok {
+			segments[point.Segment] = len(segments)
+		}
+		if segments[point.Segment] != want[i] {
+			t.Errorf("point %d (%s) is in segment %d, want %d", i, point.State, segments[point.Segment], want[i])
+		}
+	}
+}
+
+func TestTrailTracks(t *testing.T) {
+	point := func(lat, lon float64, segment int64) TrailPoint {
+		return TrailPoint{Latitude: lat, Longitude: lon, Segment: segment, State: "driving"}
+	}
+	points := []TrailPoint{
+		point(-32.36, 115.80, 1),
+		point(-32.352, 115.80, 1), // Inside the home zone
+		point(-32.36, 115.81, 1),
+		point(-32.37, 115.81, 1),
+		point(-32.38, 115.81, 2),
+	}
+	tracks := trailTracks(points, testZones)
+
+	lengths := []int{}
+	for _, track := range tracks {
+		lengths = append(lengths, len(track))
+	}
+	if len(lengths) != 3 || lengths[0] != 1 || lengths[1] != 2 || lengths[2] != 1 {
+		t.Errorf("track lengths = %v, want [1 2 1]: broken at the zone and the segment change", lengths)
+	}
+
+	collection := trailFeatureCollection(1, tracks)
+	if features := collection["features"].([]map[string]interface{}); len(features) != 1 {
+		t.Errorf("%d features, want only the track with two points", len(features))
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TripStats accumulates a trip from successive position samples. The _km, _kmh
+// and _m fields are in Teslamate's units; applyUnits fills in Distance, MaxSpeed,
+// AvgSpeed and the elevation totals in the configured units.
+type TripStats struct {
+	Active         bool      `json:"active"`
+	AutoStarted    bool      `json:"auto_started"`
+	StartedAt      time.Time `json:"started_at"`
+	EndedAt        time.Time `json:"ended_at"` // Zero while the trip is active
+	DistanceKm     float64   `json:"distance_km"`
+	MovingSeconds  float64   `json:"moving_seconds"`
+	StoppedSeconds float64   `json:"stopped_seconds"`
+	MaxSpeedKmh    float64   `json:"max_speed_kmh"`
+	AvgSpeedKmh    float64   `json:"avg_speed_kmh"` // Over moving time
+	ElevationGainM float64   `json:"elevation_gain_m"`
+	ElevationLossM float64   `json:"elevation_loss_m"`
+	StartBattery   float64   `json:"start_battery"`
+	BatteryUsed    float64   `json:"battery_used"` // Percentage points, charging along the way doesn't count against it
+
+	Distance      float64 `json:"distance"`
+	MaxSpeed      float64 `json:"max_speed"`
+	AvgSpeed      float64 `json:"avg_speed"`
+	ElevationGain float64 `json:"elevation_gain"`
+	ElevationLoss float64 `json:"elevation_loss"`
+
+	// Where the trip started, kept private for the "trip_start" reference point
+	StartLatitude  float64 `json:"-"`
+	StartLongitude float64 `json:"-"`
+
+	// Previous sample, differences from it are added to the totals. Position and
+	// elevation only count from the first real fix, until then the flags are false.
+	lastSampleAt  time.Time
+	lastDrivingAt time.Time
+	lastLatitude  float64
+	lastLongitude float64
+	hasPosition   bool
+	lastSpeed     float64
+	lastBattery   float64
+	elevationRef  float64
+	hasElevation  bool
+}
+
+const (
+	// tripElevationStep filters altitude jitter, climbs and descents are only
+	// counted once the elevation has moved this far from the last counted value
+	tripElevationStep = 2.0 // m
+
+	// tripMovingSpeed separates moving from stopped, creeping in traffic counts as moving
+	tripMovingSpeed = 1.0 // km/h
+)
+
+var (
+	trips     = map[int]*TripStats{}
+	tripMutex sync.Mutex
+)
+
+func newTrip(loc Location, auto bool) *TripStats {
+	now := time.Now()
+	trip := &TripStats{
+		Active:        true,
+		AutoStarted:   auto,
+		StartedAt:     now,
+		StartBattery:  loc.Battery,
+		lastSampleAt:  now,
+		lastDrivingAt: now,
+		lastSpeed:     loc.Speed,
+		lastBattery:   loc.Battery,
+	}
+	trip.setReference(loc)
+	return trip
+}
+
+// setReference takes the position and elevation the next sample is measured
+// from, once the car has reported them
+func (trip *TripStats) setReference(loc Location) {
+	if !trip.hasPosition && (loc.Latitude != 0 || loc.Longitude != 0) {
+		trip.StartLatitude, trip.StartLongitude = loc.Latitude, loc.Longitude
+		trip.lastLatitude, trip.lastLongitude = loc.Latitude, loc.Longitude
+		trip.hasPosition = true
+	}
+	if !trip.hasElevation && loc.hasElevation {
+		trip.elevationRef = loc.Elevation
+		trip.hasElevation = true
+	}
+}
+
+// endIfIdle ends an automatically started trip once the car hasn't driven for
+// stopAfter, so the next drive starts a new one. The trip ends when it last drove.
+func (trip *TripStats) endIfIdle(now time.Time, stopAfter time.Duration) {
+	if trip.Active && trip.AutoStarted && stopAfter > 0 && now.Sub(trip.lastDrivingAt) >= stopAfter {
+		trip.Active = false
+		trip.EndedAt = trip.lastDrivingAt
+	}
+}
+
+func tripAutoStopAfter(cfg Config) time.Duration {
+	return time.Duration(cfg.TripAutoStopAfter) * time.Minute
+}
+
+// startTrip begins a new trip from the car's current state, replacing any previous one
+func startTrip(loc Location) {
+	tripMutex.Lock()
+	defer tripMutex.Unlock()
+	trips[loc.CarID] = newTrip(loc, false)
+}
+
+// autoStartTrip begins a trip when the car starts driving, unless one is already running
+func autoStartTrip(loc Location) {
+	stopAfter := tripAutoStopAfter(getConfig())
+
+	tripMutex.Lock()
+	defer tripMutex.Unlock()
+	if trip, ok := trips[loc.CarID]; ok {
+		trip.endIfIdle(time.Now(), stopAfter)
+		if trip.Active {
+			return
+		}
+	}
+	trips[loc.CarID] = newTrip(loc, true)
+}
+
+// stopTrip ends the active trip and keeps its totals on show
+func stopTrip(carID int) {
+	tripMutex.Lock()
+	defer tripMutex.Unlock()
+	if trip, ok := trips[carID]; ok && trip.Active {
+		trip.Active = false
+		trip.EndedAt = time.Now()
+	}
+}
+
+// resetTrip forgets the car's trip
+func resetTrip(carID int) {
+	tripMutex.Lock()
+	defer tripMutex.Unlock()
+	delete(trips, carID)
+}
+
+// sampleTrip adds the movement since the previous sample to the car's active trip
+func sampleTrip(loc Location) {
+	stopAfter := tripAutoStopAfter(getConfig())
+
+	tripMutex.Lock()
+	defer tripMutex.Unlock()
+
+	trip, ok := trips[loc.CarID]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	trip.endIfIdle(now, stopAfter)
+	if !trip.Active || (loc.Latitude == 0 && loc.Longitude == 0) {
+		return
+	}
+	if loc.State == "driving" {
+		trip.lastDrivingAt = now
+	}
+
+	// A trip started before the first fix measures from the first one
+	if trip.hasPosition {
+		trip.DistanceKm += calculateDistance(trip.lastLatitude, trip.lastLongitude, loc.Latitude, loc.Longitude)
+	}
+
+	// The time since the last sample counts as moving if the car was moving at
+	// either end of it. Long gaps mean the feed dropped out, so they don't count.
+	// Teslamate stops publishing speed when parked, so the state is checked too.
+	moving := loc.State == "driving" && (trip.lastSpeed >= tripMovingSpeed || loc.Speed >= tripMovingSpeed)
+	if elapsed := now.Sub(trip.lastSampleAt); elapsed < trailGap && moving {
+		trip.MovingSeconds += elapsed.Seconds()
+	}
+	trip.MaxSpeedKmh = math.Max(trip.MaxSpeedKmh, loc.Speed)
+
+	climb := loc.Elevation - trip.elevationRef
+	if trip.hasElevation && loc.hasElevation && math.Abs(climb) >= tripElevationStep {
+		if climb > 0 {
+			trip.ElevationGainM += climb
+		} else {
+			trip.ElevationLossM -= climb
+		}
+		trip.elevationRef = loc.Elevation
+	}
+
+	if loc.Battery > 0 && trip.lastBattery > loc.Battery {
+		trip.BatteryUsed += trip.lastBattery - loc.Battery
+	}
+
+	trip.lastSampleAt = now
+	trip.lastLatitude = loc.Latitude
+	trip.lastLongitude = loc.Longitude
+	trip.lastSpeed = loc.Speed
+	if loc.Battery > 0 {
+		trip.lastBattery = loc.Battery
+	}
+	trip.setReference(loc)
+}
+
+// getTrip returns a snapshot of the car's trip with the derived totals filled in
+func getTrip(carID int) (TripStats, bool) {
+	stopAfter := tripAutoStopAfter(getConfig())
+
+	tripMutex.Lock()
+	defer tripMutex.Unlock()
+
+	trip, ok := trips[carID]
+	if !ok {
+		return TripStats{}, false
+	}
+	trip.endIfIdle(time.Now(), stopAfter)
+
+	stats := *trip
+	end := stats.EndedAt
+	if stats.Active {
+		end = time.Now()
+	}
+	stats.StoppedSeconds = math.Max(0, end.Sub(stats.StartedAt).Seconds()-stats.MovingSeconds)
+	if stats.MovingSeconds > 0 {
+		stats.AvgSpeedKmh = stats.DistanceKm / (stats.MovingSeconds / 3600)
+	}
+	return stats, true
+}
+
+// applyTripUnits fills in the configured-unit fields
+func applyTripUnits(trip TripStats, units UnitSystem) TripStats {
+	trip.Distance = units.distance(trip.DistanceKm)
+	trip.MaxSpeed = units.speed(trip.MaxSpeedKmh)
+	trip.AvgSpeed = units.speed(trip.AvgSpeedKmh)
+	trip.ElevationGain = units.elevation(trip.ElevationGainM)
+	trip.ElevationLoss = units.elevation(trip.ElevationLossM)
+	return trip
+}
+
+// formatTripDuration renders seconds as "1h 05m" or "12m"
+func formatTripDuration(seconds float64) string {
+	d := time.Duration(seconds) * time.Second
+	hours := int(d.Hours())
+	minutes := int(d.Minutes()) % 60
+	if hours > 0 {
+		return fmt.Sprintf("%dh %02dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+// serveAdminTrip reports the car's trip (GET) or starts, stops or resets it
+// (POST {"action": "start" | "stop" | "reset"})
+func serveAdminTrip(w http.ResponseWriter, r *http.Request) {
+	if !requireAuth(w, r) {
+		return
+	}
+
+	carID, err := requestedCarID(r)
+	if err != nil {
+		http.Error(w, "Invalid car parameter", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var request struct {
+			Action string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		switch request.Action {
+		case "start":
+			loc, ok := getCarLocation(carID)
+			if !ok {
+				http.Error(w, fmt.Sprintf("No data received for car %d", carID), http.StatusNotFound)
+				return
+			}
+			startTrip(loc)
+		case "stop":
+			stopTrip(carID)
+		case "reset":
+			resetTrip(carID)
+		default:
+			http.Error(w, "Unknown action, use start, stop or reset", http.StatusBadRequest)
+			return
+		}
+		queueCarEvent(carID, "location")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var response interface{}
+	if trip, ok := getTrip(carID); ok {
+		response = applyTripUnits(trip, unitsFor(getConfig().Units))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
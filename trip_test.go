@@ -0,0 +1,89 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// useTestTrip gives the test a car of its own and the default config
+func useTestTrip(t *testing.T, carID int) {
+	t.Helper()
+	setTestConfig(t, defaultConfig())
+	t.Cleanup(func() { resetTrip(carID) })
+}
+
+func TestSampleTripDistanceAndElevation(t *testing.T) {
+	const carID = 9101
+	useTestTrip(t, carID)
+
+	// Started before the car reported a position or elevation
+	startTrip(Location{CarID: carID, State: "driving"})
+
+	sample := func(lat, elevation float64) {
+		sampleTrip(Location{CarID: carID, State: "driving", Latitude: lat, Longitude: 115.8, Speed: 50, Elevation: elevation, hasElevation: true})
+	}
+	sample(-32.30, 100) // First fix, nothing to add yet
+	sample(-32.31, 101) // About 1.11 km, elevation jitter below the step
+	sample(-32.32, 105) // Another 1.11 km, 5 m up from the last counted value
+	sample(-32.32, 96)  // 9 m down
+
+	trip, ok := getTrip(carID)
+	if !ok {
+		t.Fatal("no trip")
+	}
+	if math.Abs(trip.DistanceKm-2.224) > 0.01 {
+		t.Errorf("distance = %.3f km, want about 2.224 km, not measured from 0, 0", trip.DistanceKm)
+	}
+	if trip.ElevationGainM != 5 || trip.ElevationLossM != 9 {
+		t.Errorf("elevation +%v/-%v m, want +5/-9 m, not measured from 0 m", trip.ElevationGainM, trip.ElevationLossM)
+	}
+	if trip.StartLatitude != -32.30 || trip.MaxSpeedKmh != 50 {
+		t.Errorf("start latitude %v, max speed %v, want the first fix and 50", trip.StartLatitude, trip.MaxSpeedKmh)
+	}
+}
+
+func TestSampleTripSeaLevel(t *testing.T) {
+	const carID = 9102
+	useTestTrip(t, carID)
+
+	startTrip(Location{CarID: carID, Latitude: -32.30, Longitude: 115.8, hasElevation: true})
+	sampleTrip(Location{CarID: carID, Latitude: -32.30, Longitude: 115.8, Elevation: 12, hasElevation: true})
+	if trip, _ := getTrip(carID); trip.ElevationGainM != 12 {
+		t.Errorf("elevation gain = %v m, want 12 m from a known sea level start", trip.ElevationGainM)
+	}
+}
+
+func TestAutoStartedTripEndsWhenIdle(t *testing.T) {
+	const carID = 9103
+	useTestTrip(t, carID)
+	loc := Location{CarID: carID, State: "driving", Latitude: -32.30, Longitude: 115.8}
+
+	autoStartTrip(loc)
+	tripMutex.Lock()
+	first := trips[carID]
+	parkedAt := time.Now().Add(-tripAutoStopAfter(defaultConfig()) - time.Minute)
+	first.lastDrivingAt = parkedAt
+	tripMutex.Unlock()
+
+	trip, _ := getTrip(carID)
+	if trip.Active || !trip.EndedAt.Equal(parkedAt) {
+		t.Errorf("active = %v, ended at %v, want the trip ended when the car parked at %v", trip.Active, trip.EndedAt, parkedAt)
+	}
+	autoStartTrip(loc)
+	tripMutex.Lock()
+	second := trips[carID]
+	tripMutex.Unlock()
+	if second == first || !second.Active {
+		t.Error("the next drive didn't start a new trip")
+	}
+
+	// Trips started by hand run until stopped
+	startTrip(loc)
+	tripMutex.Lock()
+	trips[carID].lastDrivingAt = parkedAt
+	tripMutex.Unlock()
+	if trip, _ := getTrip(carID); !trip.Active {
+		t.Error("a trip started by hand was ended")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import "fmt"
+
+const (
+	kmPerMile    = 1.60934
+	feetPerMetre = 3.28084
+)
+
+// Supported values for Config.Units
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+	unitsUK       = "uk" // Miles and mph, but °C and metres
+)
+
+// UnitSystem describes how values are presented. Teslamate reports km, km/h and
+// metres, and Open-Meteo is asked for the matching temperature and wind units.
+type UnitSystem struct {
+	Name        string `json:"name"`
+	Distance    string `json:"distance_unit"`
+	Speed       string `json:"speed_unit"`
+	Elevation   string `json:"elevation_unit"`
+	Temperature string `json:"temperature_unit"`
+}
+
+func unitsFor(name string) UnitSystem {
+	switch name {
+	case unitsImperial:
+		return UnitSystem{Name: unitsImperial, Distance: "mi", Speed: "mph", Elevation: "ft", Temperature: "°F"}
+	case unitsUK:
+		return UnitSystem{Name: unitsUK, Distance: "mi", Speed: "mph", Elevation: "m", Temperature: "°C"}
+	default:
+		return UnitSystem{Name: unitsMetric, Distance: "km", Speed: "km/h", Elevation: "m", Temperature: "°C"}
+	}
+}
+
+func validateUnits(name string) error {
+	switch name {
+	case "", unitsMetric, unitsImperial, unitsUK:
+		return nil
+	default:
+		return fmt.Errorf("unknown unit system %q (expected metric, imperial or uk)", name)
+	}
+}
+
+// distance converts kilometres to the display unit
+func (u UnitSystem) distance(km float64) float64 {
+	if u.Distance == "mi" {
+		return km / kmPerMile
+	}
+	return km
+}
+
+// speed converts km/h to the display unit
+func (u UnitSystem) speed(kmh float64) float64 {
+	if u.Speed == "mph" {
+		return kmh / kmPerMile
+	}
+	return kmh
+}
+
+// elevation converts metres to the display unit
+func (u UnitSystem) elevation(m float64) float64 {
+	if u.Elevation == "ft" {
+		return m * feetPerMetre
+	}
+	return m
+}
+
+// openMeteoParams returns the query parameters selecting Open-Meteo's output units
+func (u UnitSystem) openMeteoParams() string {
+	params := ""
+	if u.Temperature == "°F" {
+		params += "&temperature_unit=fahrenheit"
+	}
+	if u.Speed == "mph" {
+		params += "&wind_speed_unit=mph"
+	}
+	return params
+}
+
+// applyUnits fills the unit-suffixed fields and converts speed, range and
+// elevation to the configured unit system
+func applyUnits(loc Location, units UnitSystem) Location {
+	loc.SpeedKmh = loc.Speed
+	loc.SpeedMph = loc.Speed / kmPerMile
+	loc.RangeKm = loc.Range
+	loc.RangeMi = loc.Range / kmPerMile
+	loc.ElevationM = loc.Elevation
+	loc.ElevationFt = loc.Elevation * feetPerMetre
+	loc.KmToArrival = loc.MilesToArrival * kmPerMile
+
+	loc.Speed = units.speed(loc.SpeedKmh)
+	loc.Range = units.distance(loc.RangeKm)
+	loc.Elevation = units.elevation(loc.ElevationM)
+	loc.Units = units
+	if loc.Trip != nil {
+		trip := applyTripUnits(*loc.Trip, units)
+		loc.Trip = &trip
+	}
+	if loc.Charging != nil {
+		session := *loc.Charging
+		session.RangeAdded = units.distance(session.RangeAddedKm)
+		loc.Charging = &session
+	}
+	return loc
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook receives car events as JSON, or as a chat message for Discord and Slack
+type Webhook struct {
+	URL    string   `json:"url"`
+	Format string   `json:"format"` // "json", "discord" or "slack", empty to guess from the URL
+	Events []string `json:"events"` // Event names, empty for every event
+	CarID  int      `json:"car_id"` // 0 for every car
+}
+
+// Events derived from the MQTT feed, see messageHandler and checkRegion
+const (
+	eventDriveStarted     = "drive_started"
+	eventArrived          = "arrived"
+	eventChargingStarted  = "charging_started"
+	eventChargingFinished = "charging_finished"
+	eventBatteryLow       = "battery_low"
+	eventStateEntered     = "state_entered"
+	eventCountryEntered   = "country_entered"
+	eventTest             = "test" // Sent from the admin page only
+)
+
+var webhookEventNames = []string{
+	eventDriveStarted, eventArrived, eventChargingStarted, eventChargingFinished,
+	eventBatteryLow, eventStateEntered, eventCountryEntered,
+}
+
+const (
+	webhookFormatJSON    = "json"
+	webhookFormatDiscord = "discord"
+	webhookFormatSlack   = "slack"
+)
+
+const (
+	webhookAttempts = 5
+	webhookMinRetry = 5 * time.Second // Doubled after every failed attempt
+	webhookMaxRetry = 5 * time.Minute
+	webhookTimeout  = 10 * time.Second
+	webhookLogSize  = 50
+
+	// A navigation route that ends this close to its destination counts as arriving
+	arrivalRadiusKm = 1.0
+	// battery_low fires again only after the battery has been this far above the alert level
+	batteryAlertHysteresis = 5
+	// Reverse geocoding for state and country changes is done at most this often per car
+	regionCheckInterval = time.Minute
+)
+
+func (h Webhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL %q must be an http:// or https:// URL", h.URL)
+	}
+	switch h.Format {
+	case "", webhookFormatJSON, webhookFormatDiscord, webhookFormatSlack:
+	default:
+		return fmt.Errorf("webhook: unknown format %q, use json, discord or slack", h.Format)
+	}
+	for _, name := range h.Events {
+		if !isWebhookEvent(name) {
+			return fmt.Errorf("webhook: unknown event %q, use %s", name, strings.Join(webhookEventNames, ", "))
+		}
+	}
+	return nil
+}
+
+func isWebhookEvent(name string) bool {
+	for _, known := range webhookEventNames {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+// format returns the payload format, guessing Discord and Slack from their webhook URLs
+func (h Webhook) format() string {
+	if h.Format != "" {
+		return h.Format
+	}
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return webhookFormatJSON
+	}
+	switch {
+	case (u.Host == "discord.com" || u.Host == "discordapp.com") && strings.HasPrefix(u.Path, "/api/webhooks/"):
+		return webhookFormatDiscord
+	case u.Host == "hooks.slack.com":
+		return webhookFormatSlack
+	}
+	return webhookFormatJSON
+}
+
+func (h Webhook) wants(event string, carID int) bool {
+	if event == eventTest {
+		return true
+	}
+	if h.CarID != 0 && h.CarID != carID {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, name := range h.Events {
+		if name == event {
+			return true
+		}
+	}
+	return false
+}
+
+// host identifies the webhook in the delivery log, the rest of a Discord or
+// Slack URL is a secret token
+func (h Webhook) host() string {
+	if u, err := url.Parse(h.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "invalid URL"
+}
+
+// WebhookEvent is the body sent to "json" webhooks
+type WebhookEvent struct {
+	ID           string                 `json:"id"`
+	Event        string                 `json:"event"`
+	Time         time.Time              `json:"time"`
+	CarID        int                    `json:"car_id"`
+	CarName      string                 `json:"car_name"`
+	Message      string                 `json:"message"` // What Discord and Slack show, e.g. "🚗 Model 3 started driving in Baldivis"
+	LocationName string                 `json:"location_name"`
+	Location     Location               `json:"location"` // As served by /location, with privacy zones and units applied
+	Details      map[string]interface{} `json:"details,omitempty"`
+}
+
+// emitEvent sends an event to every webhook that wants it. It returns straight
+// away: the car's location is read in the background, so it may be called from
+// messageHandler with locationMutex held.
+func emitEvent(name string, carID int, details map[string]interface{}) {
+	cfg := getConfig()
+	var hooks []Webhook
+	for _, hook := range cfg.Webhooks {
+		if hook.wants(name, carID) {
+			hooks = append(hooks, hook)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	at := time.Now().UTC()
+	go func() {
+		event := buildWebhookEvent(name, carID, at, details)
+		log.Printf("Event %s: %s", name, event.Message)
+		for _, hook := range hooks {
+			startWebhookDelivery(hook, event, cfg.WebhookSecret)
+		}
+	}()
+}
+
+func buildWebhookEvent(name string, carID int, at time.Time, details map[string]interface{}) WebhookEvent {
+	loc, _ := getPublicLocation(carID)
+	event := WebhookEvent{
+		ID:       newEventID(),
+		Event:    name,
+		Time:     at,
+		CarID:    carID,
+		CarName:  loc.DisplayName,
+		Location: loc,
+		Details:  details,
+	}
+	if event.CarName == "" {
+		event.CarName = fmt.Sprintf("Car %d", carID)
+	}
+
+	event.LocationName = loc.PrivacyZone
+	if event.LocationName == "" && (loc.Latitude != 0 || loc.Longitude != 0) {
+		event.LocationName = getLocationName(loc.Latitude, loc.Longitude)
+	}
+	if _, ok := details["destination"]; ok && loc.PrivacyZone != "" {
+		// The destination may be the address the zone is hiding
+		event.Details = map[string]interface{}{"destination": loc.PrivacyZone}
+	}
+	event.Message = webhookMessage(event)
+	return event
+}
+
+// webhookMessage is the one-line text for chat webhooks
+func webhookMessage(event WebhookEvent) string {
+	car, loc := event.CarName, event.Location
+	place := ""
+	if event.LocationName != "" {
+		place = " in " + event.LocationName
+	}
+	detail := func(key string) string { text, _ := event.Details[key].(string); return text }
+	number := func(key string) float64 { value, _ := event.Details[key].(float64); return value }
+
+	switch event.Event {
+	case eventDriveStarted:
+		return fmt.Sprintf("🚗 %s started driving%s", car, place)
+	case eventArrived:
+		return fmt.Sprintf("🏁 %s arrived at %s", car, detail("destination"))
+	case eventChargingStarted:
+		if loc.ChargeLimitSoc == 0 {
+			return fmt.Sprintf("⚡ %s started charging%s at %.0f%%", car, place, loc.Battery)
+		}
+		return fmt.Sprintf("⚡ %s started charging%s, %.0f%% → %.0f%%", car, place, loc.Battery, loc.ChargeLimitSoc)
+	case eventChargingFinished:
+		return fmt.Sprintf("✅ %s finished charging%s: +%.1f kWh, %.0f%% → %.0f%% in %s", car, place,
+			number("energy_added"), number("start_battery"), number("battery"), formatTripDuration(number("duration_seconds")))
+	case eventBatteryLow:
+		return fmt.Sprintf("🪫 %s battery is down to %.0f%% (%.0f %s)%s", car, number("battery"), loc.Range, loc.Units.Distance, place)
+	case eventStateEntered:
+		return fmt.Sprintf("🗺️ %s entered %s", car, detail("state"))
+	case eventCountryEntered:
+		return fmt.Sprintf("🌍 %s entered %s", car, detail("country"))
+	case eventTest:
+		return fmt.Sprintf("🔔 Test notification for %s%s", car, place)
+	}
+	return fmt.Sprintf("%s: %s", car, event.Event)
+}
+
+func newEventID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WebhookDelivery records a delivery and its retries for the admin page
+type WebhookDelivery struct {
+	EventID    string    `json:"event_id"`
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	CarID      int       `json:"car_id"`
+	Webhook    string    `json:"webhook"` // Host only, see Webhook.host
+	Status     string    `json:"status"`  // "pending", "retrying", "delivered" or "failed"
+	Attempts   int       `json:"attempts"`
+	HTTPStatus int       `json:"http_status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+var (
+	webhookLog      []*WebhookDelivery // Newest first
+	webhookLogMutex sync.Mutex
+)
+
+func logWebhookDelivery(delivery *WebhookDelivery) {
+	webhookLogMutex.Lock()
+	defer webhookLogMutex.Unlock()
+	webhookLog = append([]*WebhookDelivery{delivery}, webhookLog...)
+	if len(webhookLog) > webhookLogSize {
+		webhookLog = webhookLog[:webhookLogSize]
+	}
+}
+
+// updateWebhookDelivery changes a logged delivery under webhookLogMutex
+func updateWebhookDelivery(delivery *WebhookDelivery, update func(*WebhookDelivery)) {
+	webhookLogMutex.Lock()
+	defer webhookLogMutex.Unlock()
+	update(delivery)
+}
+
+func getWebhookLog() []WebhookDelivery {
+	webhookLogMutex.Lock()
+	defer webhookLogMutex.Unlock()
+	entries := make([]WebhookDelivery, 0, len(webhookLog))
+	for _, delivery := range webhookLog {
+		entries = append(entries, *delivery)
+	}
+	return entries
+}
+
+// webhookBody renders the event in the webhook's format
+func webhookBody(hook Webhook, event WebhookEvent) ([]byte, error) {
+	switch hook.format() {
+	case webhookFormatDiscord:
+		return json.Marshal(map[string]string{"content": event.Message})
+	case webhookFormatSlack:
+		return json.Marshal(map[string]string{"text": event.Message})
+	}
+	return json.Marshal(event)
+}
+
+// webhookSignature is the X-Tesla-Location-Signature header: the hex HMAC-SHA256
+// of the request body keyed with Config.WebhookSecret, like GitHub's
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+	webhookSleep  = time.Sleep // Waits between retries, tests record the waits instead
+)
+
+// startWebhookDelivery logs the delivery as pending and makes it in the background
+func startWebhookDelivery(hook Webhook, event WebhookEvent, secret string) {
+	delivery := &WebhookDelivery{
+		EventID: event.ID,
+		Time:    time.Now(),
+		Event:   event.Event,
+		CarID:   event.CarID,
+		Webhook: hook.host(),
+		Status:  "pending",
+	}
+	logWebhookDelivery(delivery)
+	go deliverWebhook(delivery, hook, event, secret)
+}
+
+// deliverWebhook posts the event, retrying with backoff while the receiver is
+// unreachable, rate limiting or failing with a 5xx
+func deliverWebhook(delivery *WebhookDelivery, hook Webhook, event WebhookEvent, secret string) {
+	body, err := webhookBody(hook, event)
+	if err != nil {
+		updateWebhookDelivery(delivery, func(d *WebhookDelivery) { d.Status, d.Error = "failed", err.Error() })
+		return
+	}
+
+	retry := webhookMinRetry
+	for attempt := 1; ; attempt++ {
+		status, retryAfter, err := postWebhook(hook.URL, event, body, secret)
+		updateWebhookDelivery(delivery, func(d *WebhookDelivery) {
+			d.Attempts, d.HTTPStatus, d.Error = attempt, status, ""
+			if err != nil {
+				d.Error = fmt.Sprintf("%s: %v", d.Webhook, err)
+			}
+		})
+		if err == nil {
+			updateWebhookDelivery(delivery, func(d *WebhookDelivery) { d.Status = "delivered" })
+			return
+		}
+
+		retryable := status == 0 || status == http.StatusTooManyRequests || status >= 500
+		if !retryable || attempt == webhookAttempts {
+			log.Printf("Webhook %s to %s failed after %d attempts: %v", event.Event, delivery.Webhook, attempt, err)
+			updateWebhookDelivery(delivery, func(d *WebhookDelivery) { d.Status = "failed" })
+			return
+		}
+
+		wait := retry
+		if retryAfter > 0 {
+			wait = min(retryAfter, webhookMaxRetry)
+		}
+		log.Printf("Webhook %s to %s failed, retrying in %s: %v", event.Event, delivery.Webhook, wait, err)
+		updateWebhookDelivery(delivery, func(d *WebhookDelivery) { d.Status = "retrying" })
+		webhookSleep(wait)
+		retry = min(retry*2, webhookMaxRetry)
+	}
+}
+
+// postWebhook makes one attempt, returning the HTTP status (0 when there was no
+// response) and any Retry-After the receiver asked for. Errors never include
+// the URL, Discord and Slack keep the webhook's token in it.
+func postWebhook(target string, event WebhookEvent, body []byte, secret string) (int, time.Duration, error) {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, errors.New("invalid webhook URL")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tesla-location-server")
+	req.Header.Set("X-Tesla-Location-Event", event.Event)
+	req.Header.Set("X-Tesla-Location-Delivery", event.ID)
+	if secret != "" {
+		req.Header.Set("X-Tesla-Location-Signature", webhookSignature(secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, 0, nil
+	}
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	return resp.StatusCode, retryAfter, fmt.Errorf("HTTP %s", resp.Status)
+}
+
+var (
+	batteryLowCars = map[int]bool{} // Cars that have had battery_low and not recovered since
+	batteryMutex   sync.Mutex
+)
+
+// checkBatteryLevel emits battery_low when the battery drops below Config.BatteryAlertLevel
+func checkBatteryLevel(carID int, previous, battery float64) {
+	level := float64(getConfig().BatteryAlertLevel)
+	if level <= 0 {
+		return
+	}
+
+	batteryMutex.Lock()
+	defer batteryMutex.Unlock()
+	switch {
+	case battery >= level+batteryAlertHysteresis:
+		delete(batteryLowCars, carID)
+	case previous >= level && battery < level && !batteryLowCars[carID]:
+		batteryLowCars[carID] = true
+		emitEvent(eventBatteryLow, carID, map[string]interface{}{"battery": battery, "alert_level": level})
+	}
+}
+
+// checkArrival emits arrived when navigation ends close to the destination,
+// the car's route is about to be cleared
+func checkArrival(loc Location) {
+	if loc.Destination == "" || (loc.DestinationLatitude == 0 && loc.DestinationLongitude == 0) {
+		return
+	}
+	distance := calculateDistance(loc.Latitude, loc.Longitude, loc.DestinationLatitude, loc.DestinationLongitude)
+	if distance <= arrivalRadiusKm {
+		emitEvent(eventArrived, loc.CarID, map[string]interface{}{"destination": loc.Destination})
+	}
+}
+
+// carRegion is the last place seen for a car. Names depend on the provider and
+// its language, so regions are compared by country code and normalised state
+// name, and only between answers from the same provider.
+type carRegion struct {
+	Provider          string
+	State, Country    string // As reported, for the event details
+	StateKey, CodeKey string // Normalised for comparisons
+	CheckedAt         time.Time
+}
+
+var (
+	carRegions  = map[int]carRegion{}
+	regionMutex sync.Mutex
+)
+
+// checkRegion emits state_entered or country_entered when reverse geocoding
+// puts the car somewhere new. The first place seen after startup, or after the
+// answering provider changed, is only remembered, and nothing is looked up
+// unless a webhook wants these events.
+func checkRegion(loc Location) {
+	cfg := getConfig()
+	if loc.Latitude == 0 && loc.Longitude == 0 {
+		return
+	}
+	wanted := false
+	for _, hook := range cfg.Webhooks {
+		wanted = wanted || hook.wants(eventStateEntered, loc.CarID) || hook.wants(eventCountryEntered, loc.CarID)
+	}
+	if !wanted {
+		return
+	}
+
+	regionMutex.Lock()
+	previous, known := carRegions[loc.CarID]
+	if known && time.Since(previous.CheckedAt) < regionCheckInterval {
+		regionMutex.Unlock()
+		return
+	}
+	previous.CheckedAt = time.Now()
+	carRegions[loc.CarID] = previous
+	regionMutex.Unlock()
+
+	// Privacy zones hide the position from reverse geocoding too
+	lat, lon := applyPrivacy(loc, cfg.PrivacyZones).lookupPosition()
+	place, provider, err := lookupPlace(lat, lon)
+	if err != nil || place.CountryCode == "" {
+		return
+	}
+
+	current := carRegion{
+		Provider:  provider,
+		State:     place.State,
+		Country:   place.Country,
+		StateKey:  strings.ToLower(strings.TrimSpace(place.State)),
+		CodeKey:   strings.ToUpper(strings.TrimSpace(place.CountryCode)),
+		CheckedAt: previous.CheckedAt,
+	}
+	regionMutex.Lock()
+	carRegions[loc.CarID] = current
+	regionMutex.Unlock()
+
+	details := map[string]interface{}{
+		"state": place.State, "country": place.Country, "country_code": current.CodeKey,
+		"previous_state": previous.State, "previous_country": previous.Country, "previous_country_code": previous.CodeKey,
+	}
+	switch {
+	case previous.CodeKey == "" || previous.Provider != current.Provider:
+		// First place since startup, or names from another provider that can't be compared
+	case current.CodeKey != previous.CodeKey:
+		emitEvent(eventCountryEntered, loc.CarID, details)
+	case current.StateKey != "" && previous.StateKey != "" && current.StateKey != previous.StateKey:
+		emitEvent(eventStateEntered, loc.CarID, details)
+	}
+}
+
+// WebhookStatus is served by /admin/webhooks
+type WebhookStatus struct {
+	Webhooks int               `json:"webhooks"`
+	Events   []string          `json:"events"`
+	Log      []WebhookDelivery `json:"log"`
+}
+
+// serveAdminWebhooks reports recent deliveries (GET) or sends a test event to
+// a webhook, saved or not (POST {"webhook": {...}})
+func serveAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !requireAuth(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var request struct {
+			Webhook Webhook `json:"webhook"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := request.Webhook.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg := getConfig()
+		event := buildWebhookEvent(eventTest, cfg.DefaultCarID, time.Now().UTC(), nil)
+		startWebhookDelivery(request.Webhook, event, cfg.WebhookSecret)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WebhookStatus{
+		Webhooks: len(getConfig().Webhooks),
+		Events:   webhookEventNames,
+		Log:      getWebhookLog(),
+	})
+}
+
+// validateWebhooks checks the webhook settings in validateConfig
+func validateWebhooks(cfg Config) error {
+	for _, hook := range cfg.Webhooks {
+		if err := hook.validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.BatteryAlertLevel < 0 || cfg.BatteryAlertLevel > 100 {
+		return errors.New("battery alert level must be between 0 and 100%")
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver answers each request with the next status and records what it got
+type webhookReceiver struct {
+	mutex      sync.Mutex
+	statuses   []int
+	retryAfter string
+	requests   []*http.Request
+	bodies     [][]byte
+}
+
+func (rec *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.requests = append(rec.requests, r)
+	rec.bodies = append(rec.bodies, body)
+	status := http.StatusNoContent
+	if len(rec.statuses) > 0 {
+		status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+	}
+	if status != http.StatusNoContent && rec.retryAfter != "" {
+		w.Header().Set("Retry-After", rec.retryAfter)
+	}
+	w.WriteHeader(status)
+}
+
+// recordWebhookWaits replaces the retry sleep for the rest of the test
+func recordWebhookWaits(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var waits []time.Duration
+	webhookSleep = func(d time.Duration) { waits = append(waits, d) }
+	t.Cleanup(func() { webhookSleep = time.Sleep })
+	return &waits
+}
+
+func TestPostWebhookSignature(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	event := buildWebhookEvent(eventDriveStarted, 1, time.Now(), nil)
+	body, err := webhookBody(Webhook{URL: server.URL}, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"s3cret", ""} {
+		if _, _, err := postWebhook(server.URL, event, body, secret); err != nil {
+			t.Fatalf("postWebhook: %v", err)
+		}
+	}
+
+	signed, unsigned := receiver.requests[0], receiver.requests[1]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(receiver.bodies[0])
+	if got, want := signed.Header.Get("X-Tesla-Location-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature = %q, want %q", got, want)
+	}
+	if signed.Header.Get("X-Tesla-Location-Event") != eventDriveStarted || signed.Header.Get("X-Tesla-Location-Delivery") != event.ID {
+		t.Errorf("event headers = %v", signed.Header)
+	}
+	if sig := unsigned.Header.Get("X-Tesla-Location-Signature"); sig != "" {
+		t.Errorf("signature %q sent without a secret", sig)
+	}
+}
+
+func TestDeliverWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		retryAfter string
+		status     string
+		attempts   int
+		waits      []time.Duration
+	}{
+		{"delivered first time", nil, "", "delivered", 1, nil},
+		{"backs off on 5xx", []int{500, 502, 503}, "", "delivered", 4, []time.Duration{webhookMinRetry, 2 * webhookMinRetry, 4 * webhookMinRetry}},
+		{"honours Retry-After", []int{429}, "42", "delivered", 2, []time.Duration{42 * time.Second}},
+		{"caps Retry-After", []int{429}, "3600", "delivered", 2, []time.Duration{webhookMaxRetry}},
+		{"gives up on 4xx", []int{404}, "", "failed", 1, nil},
+		{"gives up after the last attempt", []int{500, 500, 500, 500, 500}, "", "failed", webhookAttempts,
+			[]time.Duration{webhookMinRetry, 2 * webhookMinRetry, 4 * webhookMinRetry, 8 * webhookMinRetry}},
+	}
+	for _, test := range tests {
+		waits := recordWebhookWaits(t)
+		receiver := &webhookReceiver{statuses: test.statuses, retryAfter: test.retryAfter}
+		server := httptest.NewServer(receiver)
+
+		hook := Webhook{URL: server.URL}
+		delivery := &WebhookDelivery{Webhook: hook.host()}
+		deliverWebhook(delivery, hook, buildWebhookEvent(eventArrived, 1, time.Now(), nil), "")
+		server.Close()
+
+		if delivery.Status != test.status || delivery.Attempts != test.attempts {
+			t.Errorf("%s: status %q after %d attempts, want %q after %d", test.name, delivery.Status, delivery.Attempts, test.status, test.attempts)
+		}
+		if len(receiver.requests) != test.attempts {
+			t.Errorf("%s: receiver got %d requests, want %d", test.name, len(receiver.requests), test.attempts)
+		}
+		if len(*waits) != len(test.waits) {
+			t.Errorf("%s: waited %v, want %v", test.name, *waits, test.waits)
+			continue
+		}
+		for i := range test.waits {
+			if (*waits)[i] != test.waits[i] {
+				t.Errorf("%s: waited %v, want %v", test.name, *waits, test.waits)
+				break
+			}
+		}
+	}
+}